@@ -0,0 +1,99 @@
+package bag
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+BootstrappingInfo of Ub response defined in TS 24.109 Annex C
+
+	<BootstrappingInfo xmlns="uri:3gpp-gba">
+	  <btid>...</btid>
+	  <lifetime>2006-01-02T15:04:05Z</lifetime>
+	  <!-- optional elements in other namespace -->
+	</BootstrappingInfo>
+*/
+
+// BootstrappingInfo is body of successful bootstrap response from BSF
+type BootstrappingInfo struct {
+	BTID     string
+	Lifetime time.Time
+	Ext      []ExtElement // optional extension elements
+}
+
+// ExtElement is extension element in BootstrappingInfo
+type ExtElement struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   string     `xml:",innerxml"`
+}
+
+type bootstrappingInfoXML struct {
+	XMLName  xml.Name     `xml:"uri:3gpp-gba BootstrappingInfo"`
+	BTID     string       `xml:"btid"`
+	Lifetime string       `xml:"lifetime"`
+	Ext      []ExtElement `xml:",any"`
+}
+
+func (b BootstrappingInfo) MarshalXML(e *xml.Encoder, s xml.StartElement) error {
+	return e.Encode(bootstrappingInfoXML{
+		BTID:     b.BTID,
+		Lifetime: b.Lifetime.UTC().Format(time.RFC3339),
+		Ext:      b.Ext})
+}
+
+func (b *BootstrappingInfo) UnmarshalXML(d *xml.Decoder, s xml.StartElement) (e error) {
+	tmp := bootstrappingInfoXML{}
+	if e = d.DecodeElement(&tmp, &s); e != nil {
+		return
+	}
+	if tmp.XMLName.Space != "uri:3gpp-gba" {
+		return fmt.Errorf("invalid BootstrappingInfo namespace %s", tmp.XMLName.Space)
+	}
+	b.BTID = tmp.BTID
+	if b.Lifetime, e = time.Parse(time.RFC3339, tmp.Lifetime); e != nil {
+		return fmt.Errorf("invalid BootstrappingInfo lifetime %s", tmp.Lifetime)
+	}
+	b.Ext = tmp.Ext
+	for i := range b.Ext {
+		// keep prefix declarations used in inner XML as raw attributes,
+		// default namespace is in XMLName
+		attrs := []xml.Attr{}
+		for _, a := range b.Ext[i].Attrs {
+			if a.Name.Space == "xmlns" {
+				a.Name = xml.Name{Local: "xmlns:" + a.Name.Local}
+			} else if a.Name.Space == "" && a.Name.Local == "xmlns" {
+				continue
+			}
+			attrs = append(attrs, a)
+		}
+		b.Ext[i].Attrs = attrs
+	}
+	return
+}
+
+// Bytes returns XML document of the BootstrappingInfo
+func (b BootstrappingInfo) Bytes() ([]byte, error) {
+	data, e := xml.Marshal(b)
+	if e != nil {
+		return nil, e
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// ParseBootstrappingInfo parse BootstrappingInfo XML document and validate B-TID and lifetime
+func ParseBootstrappingInfo(data []byte) (b BootstrappingInfo, e error) {
+	if e = xml.Unmarshal(data, &b); e != nil {
+		return
+	}
+	if _, _, e = ParseBTID(b.BTID); e != nil {
+		return
+	}
+	if !b.Lifetime.After(time.Now()) {
+		e = errors.New("lifetime of BootstrappingInfo is already expired")
+	}
+	return
+}
@@ -1,17 +1,16 @@
 package bag
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/rand"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -105,28 +104,102 @@ func (a AV) String() string {
 		a.IMPI, a.RAND, a.AUTN, a.RES, a.IK, a.CK)
 }
 
-/*
-	func (a AV) MarshalXML(e *xml.Encoder, s xml.StartElement) error {
-		tmp := struct {
-			Xmlns   string `xml:"xmlns,attr"`
-			BTID    string `xml:"btid"`
-			Liftime string `xml:"lifetime"`
-		}{
-			"uri:3gpp-gba",
-			base64.StdEncoding.EncodeToString(a.RAND) + "@" + a.Host,
-			a.Expires.UTC().Format(time.RFC3339)}
-		return e.EncodeElement(tmp, s)
+// Session is bootstrapping session data of the B-TID
+type Session struct {
+	AV        AV
+	Type      GBAType
+	BootTime  time.Time // zero until bootstrap is completed
+	NextNonce string    // nonce for next bootstrap, empty until bootstrap is completed
+	Realm     string    // Digest-Realm of GBA Digest, empty for other types
+	GUSS      *GUSS     // nil if no GUSS for the subscriber
+}
+
+func (s *Session) UnmarshalText(b []byte) (e error) {
+	t := strings.SplitN(string(b), ":", 6)
+	if len(t) != 6 {
+		e = fmt.Errorf("invalid data")
+	} else if gt, err := strconv.Atoi(t[0]); err != nil {
+		e = fmt.Errorf("invalid data")
+	} else if i, err := strconv.ParseInt(t[1], 10, 64); err != nil {
+		e = fmt.Errorf("invalid data")
+	} else if g, err := base64.StdEncoding.DecodeString(t[4]); err != nil {
+		e = fmt.Errorf("invalid data")
+	} else if e = s.AV.UnmarshalText([]byte(t[5])); e == nil {
+		s.Type = GBAType(gt)
+		s.NextNonce = t[2]
+		s.Realm = t[3]
+		if i != 0 {
+			s.BootTime = time.Unix(i, 0).UTC()
+		} else {
+			s.BootTime = time.Time{}
+		}
+		if len(g) != 0 {
+			s.GUSS, e = ParseGUSS(g)
+		} else {
+			s.GUSS = nil
+		}
 	}
-*/
+	return
+}
+
+func (s Session) MarshalText() (b []byte, e error) {
+	var t int64
+	if !s.BootTime.IsZero() {
+		t = s.BootTime.Unix()
+	}
+	var g []byte
+	if s.GUSS != nil {
+		if g, e = xml.Marshal(s.GUSS); e != nil {
+			return
+		}
+	}
+	if b, e = s.AV.MarshalText(); e == nil {
+		b = append([]byte(strconv.Itoa(int(s.Type))+":"+
+			strconv.FormatInt(t, 10)+":"+s.NextNonce+":"+s.Realm+":"+
+			base64.StdEncoding.EncodeToString(g)+":"), b...)
+	}
+	return
+}
+
+// realm returns realm of the Digest challenge, BSF host for AKA
+func (s Session) realm(host string) string {
+	if s.Type == GBADigest {
+		return s.Realm
+	}
+	return host
+}
+
+// setResponse sets response of the Authorization with the session credential
+func (s Session) setResponse(auth *Authorization, method string, body []byte) {
+	if s.Type == GBADigest {
+		auth.SetDigestResponse(method, s.AV.RES, body)
+	} else {
+		auth.SetResponse(method, s.AV.RES, body)
+	}
+}
 
 var (
 	bsfResultInvalidRequest = http.StatusBadRequest
 	bsfResultUnableToGetAV  = http.StatusForbidden
+	bsfResultUnknownTMPI    = http.StatusNotFound
 )
 
-func makeBTID(auth Authorization) string {
-	tmp := sha256.Sum256([]byte(auth.Nonce + auth.Username))
-	return base64.StdEncoding.EncodeToString(tmp[:]) + "@" + auth.Realm
+func makeBTID(auth Authorization, impi, host string) string {
+	rand, autn, _, e := auth.BootstrapNonce()
+	if e != nil {
+		return ""
+	}
+	return BTIDGen.BTID(rand, autn, impi, host)
+}
+
+// makeNextNonce returns nonce for next bootstrap with the same AV.
+// Random server data is appended to RAND and AUTN as defined in RFC 3310.
+func makeNextNonce(av AV) string {
+	n := make([]byte, 16)
+	rand.Read(n)
+	a := Authorization{}
+	a.SetBootstrapNonce(av.RAND, av.AUTN, n...)
+	return a.Nonce
 }
 
 func BootstrapHandler(w http.ResponseWriter, r *http.Request) {
@@ -141,7 +214,8 @@ func BootstrapHandler(w http.ResponseWriter, r *http.Request) {
 	if strings.Contains(r.Host, ":") {
 		r.Host, _, _ = net.SplitHostPort(r.Host)
 	}
-	if auth.Realm != r.Host {
+	if auth.Realm != r.Host && auth.Response == [16]byte{} {
+		// realm of response is checked with the session
 		w.WriteHeader(bsfResultInvalidRequest)
 		return
 	}
@@ -155,122 +229,292 @@ func BootstrapHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	btid := makeBTID(auth)
-	av, ttl, e := getCachedAV(btid)
+	impi := auth.Username
+	if IsTMPI(auth.Username) {
+		// UE retries with IMPI if the TMPI is unknown
+		if impi, e = resolveTMPI(auth.Username); e != nil || impi == "" {
+			Log("[INFO]", "bootstrap from", auth.Username, "rejected:", "unknown TMPI")
+			w.WriteHeader(bsfResultUnknownTMPI)
+			return
+		}
+	}
+
+	var s Session
+	var ttl time.Time
+	btid := makeBTID(auth, impi, r.Host)
+	if btid != "" {
+		s, ttl, _ = Store.GetSession(btid)
+	}
+	if s.AV.IMPI != impi {
+		s = Session{}
+		ttl = time.Time{}
+	}
 
+	stale := false
+	var issued time.Time // issue time of the sealed nonce of stateless challenge
 	if auth.Response != [16]byte{} {
-		if ttl.IsZero() {
+		if !s.BootTime.IsZero() {
+			if auth.Nonce != s.NextNonce {
+				// bootstrapped session accepts only the nextnonce,
+				// so challenge again with new AV as initial request
+				Log("[INFO]", "bootstrap from", impi, "rejected:", "nonce does not match nextnonce")
+				s = Session{}
+				ttl = time.Time{}
+				auts = nil
+				auth.Response = [16]byte{}
+			}
+		} else if ChallengeKey != nil {
+			var c Challenge
+			if s.AV, s.Type, c, e = openStatelessNonce(auth, impi); e == nil {
+				if s.Type == GBADigest {
+					// realm is authenticated with the sealed data
+					s.Realm = auth.Realm
+				}
+				s.GUSS, _, _ = getCachedGUSS(impi)
+				issued = c.Issued
+				ttl = issued
+				e = verifyStatelessChallenge(auth, c)
+			}
+			if e == errStaleNonce {
+				stale = true
+				auts = nil
+				ttl = time.Time{}
+			} else if e != nil {
+				Log("[INFO]", "bootstrap from", impi, "rejected:", e)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		} else if e = verifyChallenge(auth); e == errStaleNonce || (e == nil && ttl.IsZero()) {
+			// challenge again with new AV
+			stale = true
+			auts = nil
+			ttl = time.Time{}
+		} else if e == errInvalidRealm {
 			w.WriteHeader(bsfResultInvalidRequest)
 			return
+		} else if e != nil {
+			Log("[INFO]", "bootstrap from", impi, "rejected:", e)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
 		}
+	}
 
+	av := s.AV
+	if auth.Response != [16]byte{} && !stale {
+		if auth.Realm != s.realm(r.Host) {
+			w.WriteHeader(bsfResultInvalidRequest)
+			return
+		}
 		cres := auth.Response
 		body, _ := io.ReadAll(r.Body)
 		defer r.Body.Close()
 
-		auth.SetBootstrapNonce(av.RAND, av.AUTN)
 		if auts != nil {
 			av.RES = []byte{}
 			ttl = time.Time{}
+			auth.SetResponse(r.Method, av.RES, body)
+		} else {
+			s.setResponse(&auth, r.Method, body)
 		}
-		auth.SetResponse(r.Method, av.RES, body)
 
 		if auth.Response != cres {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+		if auts == nil && !issued.IsZero() {
+			// sealed nonce is accepted only once, so replay cannot restore revoked session
+			if ok, e := Store.AcceptNonceCount("bsf:"+auth.Nonce, "", 1, issued.Add(Lifetime.Nonce*2)); e != nil {
+				Log("[ERR]", "failed to record used nonce:", e)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			} else if !ok {
+				Log("[INFO]", "bootstrap from", impi, "rejected:", "nonce is already used")
+				s = Session{}
+				ttl = time.Time{}
+				auth.Response = [16]byte{}
+			}
+		}
 	} else if auts != nil {
 		w.WriteHeader(bsfResultInvalidRequest)
 		return
 	}
 
+	cqop := qop
 	if ttl.IsZero() {
-		av, e = MultimediaAuthRequest(auth.Username, av.RAND, auts)
+		// HSS selects the scheme by the subscription, product token of UE cannot downgrade it
+		scheme := ""
+		digest := HasProductToken(r.UserAgent(), DigestProductToken)
+		if r.TLS == nil {
+			// 2G GBA and GBA Digest require server authenticated TLS
+			if digest {
+				Log("[INFO]", "bootstrap from", impi, "rejected:", GBADigest, "without TLS")
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			scheme = SchemeAKAv1MD5
+		}
+		guss, gts, _ := getCachedGUSS(impi)
+		uicc := HasProductToken(r.UserAgent(), UICCProductToken)
+		item, nguss, nts, e := MultimediaAuthRequest(impi, scheme, av.RAND, auts, gts,
+			uicc && (guss == nil || guss.UICCType != "GBA"))
 		if e != nil {
 			w.WriteHeader(bsfResultUnableToGetAV)
 			return
 		}
-		av.IMPI = auth.Username
-		auth.SetBootstrapNonce(av.RAND, av.AUTN)
-		btid = makeBTID(auth)
+		t := GBAME
+		av = item.AV
+		switch item.Scheme {
+		case Scheme2GGBA:
+			t = GBA2G
+			ksInput := make([]byte, 16)
+			rand.Read(ksInput)
+			av, e = item.SIM.AV(ksInput, impi)
+		case SchemeSIPDigest:
+			t = GBADigest
+			n := make([]byte, 32)
+			rand.Read(n)
+			av, e = item.Digest.AV(n[:16], n[16:], impi)
+			if q := digestQop(item.Digest.QoP); len(q) != 0 {
+				cqop = q
+			}
+		}
+		if e != nil {
+			Log("[INFO]", "bootstrap from", impi, "rejected:", e)
+			w.WriteHeader(bsfResultUnableToGetAV)
+			return
+		}
+		if t == GBADigest && !digest {
+			Log("[INFO]", "bootstrap from", impi, "rejected:", "UE does not support", t)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if (t == GBA2G || t == GBADigest) && r.TLS == nil {
+			Log("[INFO]", "bootstrap from", impi, "rejected:", t, "without TLS")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if nguss != nil {
+			guss = nguss
+			setCachedGUSS(impi, guss, nts)
+		}
+		av.IMPI = impi
+		s = Session{AV: av, Type: t, GUSS: guss}
+		if t == GBADigest {
+			s.Realm = item.Digest.Realm
+		} else if t == GBAME && uicc && (guss == nil || guss.UICCType != "GBA") {
+			if GBAUCapable(av.AUTN) {
+				// UICC is GBA_U capable
+				s.Type = GBAU
+				s.AV.AUTN = GBAUAUTN(av.AUTN, av.IK)
+				av = s.AV
+			} else {
+				Log("[INFO]", "GBA_ME is used for", impi, ":", "no AMF separation bit in AV from HSS")
+			}
+		}
 
-		ttl = time.Now().Add(expiration).UTC()
-		setCachedAV(btid, av, ttl)
-	} else {
-		auth.SetBootstrapNonce(av.RAND, av.AUTN)
+		if ChallengeKey == nil {
+			auth.SetBootstrapNonce(av.RAND, av.AUTN)
+			btid = makeBTID(auth, impi, r.Host)
+			ttl = time.Now().Add(Lifetime.Bootstrap(av.IMPI, guss)).UTC()
+			if e = Store.SetSession(btid, s, ttl); e != nil {
+				Log("[ERR]", "failed to store session of", impi, ":", e)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
 	}
 
-	if auth.Response == [16]byte{} || auts != nil {
+	if auth.Response == [16]byte{} || auts != nil || stale {
+		var c Challenge
+		if ChallengeKey != nil {
+			c, e = statelessChallenge(s, s.realm(r.Host), cqop)
+		} else {
+			c, e = issueChallenge(s.realm(r.Host), auth.Nonce, "", cqop)
+		}
+		if e != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		alg := "AKAv1-MD5"
+		if s.Type == GBA2G || s.Type == GBADigest {
+			// nonce is RAND || server data without AUTN
+			alg = "MD5"
+		}
 		w.Header().Set("WWW-Authenticate", WWWAuthenticate{
-			Realm:     r.Host,
-			Nonce:     auth.Nonce,
-			Qop:       qop,
-			Opaque:    NewRandText(),
-			Algorithm: "AKAv1-MD5"}.String())
+			Realm:     c.Realm,
+			Nonce:     c.Nonce,
+			Qop:       c.Qop,
+			Opaque:    c.Opaque,
+			Stale:     stale,
+			Algorithm: alg}.String())
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	/*
-		body, e := xml.Marshal(av)
-		if e != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+	if s.BootTime.IsZero() {
+		// bootstrap with nextnonce keeps the time of AKA run,
+		// so the same Ks never outlives the lifetime from it
+		s.BootTime = time.Now().UTC()
+	}
+	s.NextNonce = makeNextNonce(av)
+	ttl = s.BootTime.Add(Lifetime.Bootstrap(s.AV.IMPI, s.GUSS))
+	if e = Store.SetSession(btid, s, ttl); e != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, e := BootstrappingInfo{BTID: btid, Lifetime: ttl}.Bytes()
+	if e != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if HasProductToken(r.UserAgent(), TMPIProductToken) {
+		// UE derives the same TMPI from Ks
+		tmpi := TMPI(Ks(s.AV.CK, s.AV.IK), r.Host)
+		if e = setTMPI(tmpi, s.AV.IMPI, ttl); e != nil {
+			Log("[ERR]", "failed to store TMPI of", s.AV.IMPI, ":", e)
+		} else {
+			w.Header().Set("Server", productName+" BSF "+TMPIProductToken)
 		}
-		body = append([]byte(xml.Header), body...)
-	*/
-	body := []byte(`<?xml version="1.0" encoding="UTF-8"?>` +
-		`<BootstrappingInfo xmlns="uri:3gpp-gba">` +
-		`<btid>` + btid + `</btid>` +
-		`<lifetime>` + ttl.Format(time.RFC3339) + `</lifetime>` +
-		`</BootstrappingInfo>`)
+	}
 
 	w.Header().Set("Expires", ttl.Format(http.TimeFormat))
 	w.Header().Set("Content-Type", "application/vnd.3gpp.bsf+xml")
-	/*
-		auth.SetResponse("", av.RES, body)
-		w.Header().Set("Authentication-Info", AuthenticationInfo{
-			Nextnonce: base64.StdEncoding.EncodeToString(append(av.RAND, av.AUTN...)),
-			Qop:       auth.Qop,
-			Rspauth:   auth.Response,
-			Cnonce:    auth.Cnonce,
-			Nc:        auth.Nc}.String())
-	*/
+	s.setResponse(&auth, "", body)
+	w.Header().Set("Authentication-Info", AuthenticationInfo{
+		Nextnonce: s.NextNonce,
+		Qop:       auth.Qop,
+		Rspauth:   auth.Response,
+		Cnonce:    auth.Cnonce,
+		Nc:        auth.Nc}.String())
 	w.WriteHeader(http.StatusOK)
 	w.Write(body)
 }
 
+// digestQop returns qop of BSF offered in Digest-QoP from HSS
+func digestQop(dq string) (ret []string) {
+	for _, q := range qop {
+		for _, d := range strings.Split(dq, ",") {
+			if strings.TrimSpace(d) == q {
+				ret = append(ret, q)
+			}
+		}
+	}
+	return
+}
+
 /*
 	func KeyDerivationFromCache(btid string, naf string, vid uint8, pid uint32) []byte {
-		av, _ := getCachedAV(btid)
+		av, _ := Store.GetSession(btid)
 		if av.RAND == nil {
 			return nil
 		}
 		return KeyDerivation(av.CK, av.IK, av.RAND, av.IMPI, naf, vid, pid)
 	}
 */
-func KeyDerivation(ck, ik, rand []byte, impi, naf string, vid uint8, pid uint32) []byte {
-	buf := new(bytes.Buffer)
-	// FC
-	buf.WriteByte(0x01)
-	// P0 = "gba-me", L0 = 6 octets
-	buf.WriteString("gba-me")
-	binary.Write(buf, binary.BigEndian, uint16(len("bga-me")))
-	// P1 = RAND, L1 = length of RAND (16 octets)
-	buf.Write(rand)
-	binary.Write(buf, binary.BigEndian, uint16(len(rand)))
-	// P2 = IMPI encoded to an octet string using UTF-8 encoding
-	// L2 = length of IMPI (not greater than 65535)
-	buf.WriteString(impi)
-	binary.Write(buf, binary.BigEndian, uint16(len(impi)))
-	// P3 = NAF_ID with the FQDN part of the NAF_ID encoded to an octet string using UTF-8 encoding
-	// L3 = length of NAF_ID (not greater than 65535)
-	buf.WriteString(naf)
-	binary.Write(buf, binary.BigEndian, vid)
-	binary.Write(buf, binary.BigEndian, pid)
-	binary.Write(buf, binary.BigEndian, uint16(len(naf)+5))
-
-	mac := hmac.New(sha256.New, append(ck, ik...))
-	buf.WriteTo(mac)
-	return mac.Sum(nil)
+// KeyDerivation returns Ks_NAF of GBA_ME
+func KeyDerivation(ck, ik, rand []byte, impi string, nafid NAFID) []byte {
+	k, _ := KsExtNAF(Ks(ck, ik), rand, impi, nafid.Bytes())
+	return k
 }
@@ -0,0 +1,48 @@
+package bag
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// BTIDGenerator generates B-TID of bootstrapping session
+type BTIDGenerator interface {
+	BTID(rand, autn []byte, impi, domain string) string
+}
+
+// RandBTID generates B-TID as base64(RAND)@BSF_server_domain_name defined in TS 33.220
+type RandBTID struct{}
+
+func (RandBTID) BTID(rand, autn []byte, impi, domain string) string {
+	return base64.StdEncoding.EncodeToString(rand) + "@" + domain
+}
+
+// HashBTID generates B-TID as base64(SHA-256(nonce+IMPI))@BSF_server_domain_name
+type HashBTID struct{}
+
+func (HashBTID) BTID(rand, autn []byte, impi, domain string) string {
+	nonce := base64.StdEncoding.EncodeToString(append(append([]byte{}, rand...), autn...))
+	tmp := sha256.Sum256([]byte(nonce + impi))
+	return base64.StdEncoding.EncodeToString(tmp[:]) + "@" + domain
+}
+
+// BTIDGen is B-TID generator of BSF
+var BTIDGen BTIDGenerator = RandBTID{}
+
+// ParseBTID returns RAND part and BSF domain name of the B-TID
+func ParseBTID(btid string) (rand []byte, domain string, e error) {
+	i := strings.LastIndex(btid, "@")
+	if i <= 0 || i == len(btid)-1 {
+		e = errors.New("invalid B-TID format")
+		return
+	}
+	domain = btid[i+1:]
+	if rand, e = base64.StdEncoding.DecodeString(btid[:i]); e != nil {
+		e = errors.New("invalid B-TID format")
+	} else if len(rand) == 0 {
+		e = errors.New("invalid B-TID format")
+	}
+	return
+}
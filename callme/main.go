@@ -29,6 +29,8 @@ func main() {
 	res := flag.String("res", "", "AV RES value overwrite")
 	ik := flag.String("ik", "", "AV IK value overwrite")
 	ck := flag.String("ck", "", "AV CK value overwrite")
+	flag.StringVar(&r.NextNonce, "nextnonce", "", "BSF nextnonce value overwrite")
+	flag.BoolVar(&r.UICCKey, "uicc-key", false, "use Ks_int_NAF of GBA_U for NAF")
 	flag.BoolVar(&r.ClearCache, "clear", false,
 		"clear Authentication and B-TID chace in client")
 
@@ -0,0 +1,111 @@
+package bag
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Challenge is state of Digest challenge recorded at issue time
+type Challenge struct {
+	Nonce  string
+	Opaque string
+	Realm  string
+	Issued time.Time
+	Qop    []string // offered qop
+}
+
+func (c *Challenge) UnmarshalText(b []byte) (e error) {
+	t := strings.SplitN(string(b), ":", 4)
+	if len(t) != 4 {
+		e = fmt.Errorf("invalid data")
+	} else if i, err := strconv.ParseInt(t[0], 10, 64); err != nil {
+		e = fmt.Errorf("invalid data")
+	} else {
+		c.Issued = time.Unix(i, 0).UTC()
+		c.Opaque = t[1]
+		c.Qop = nil
+		if t[2] != "" {
+			c.Qop = strings.Split(t[2], ",")
+		}
+		c.Realm = t[3]
+	}
+	return
+}
+
+func (c Challenge) MarshalText() (b []byte, e error) {
+	b = []byte(strconv.FormatInt(c.Issued.Unix(), 10) +
+		":" + c.Opaque +
+		":" + strings.Join(c.Qop, ",") +
+		":" + c.Realm)
+	return
+}
+
+var (
+	errInvalidNonce  = errors.New("unknown nonce")
+	errInvalidOpaque = errors.New("opaque does not match")
+	errInvalidRealm  = errors.New("realm does not match")
+	errInvalidQop    = errors.New("qop is not offered")
+	errStaleNonce    = errors.New("nonce is expired")
+)
+
+// issueChallenge records new challenge state.
+// Expired state is kept for one more nonce lifetime to answer stale=true.
+func issueChallenge(realm, nonce, opaque string, qop []string) (c Challenge, e error) {
+	c = Challenge{
+		Nonce:  nonce,
+		Opaque: opaque,
+		Realm:  realm,
+		Issued: time.Now().UTC(),
+		Qop:    qop}
+	if c.Opaque == "" {
+		c.Opaque = NewRandText()
+	}
+	v, _ := c.MarshalText()
+	e = Store.Set("nonce:"+nonce, v, c.Issued.Add(Lifetime.Nonce*2))
+	return
+}
+
+// verifyChallenge checks the Authorization with recorded challenge state
+func verifyChallenge(auth Authorization) error {
+	data, ttl, e := Store.Get("nonce:" + auth.Nonce)
+	if e != nil {
+		return e
+	}
+	if data == nil || ttl.IsZero() {
+		return errInvalidNonce
+	}
+	c := Challenge{Nonce: auth.Nonce}
+	if e = c.UnmarshalText(data); e != nil {
+		return errInvalidNonce
+	}
+
+	if c.Realm != auth.Realm {
+		return errInvalidRealm
+	}
+	if c.Opaque != auth.Opaque {
+		return errInvalidOpaque
+	}
+	if len(c.Qop) != 0 {
+		ok := false
+		for _, q := range c.Qop {
+			ok = ok || q == auth.Qop
+		}
+		if !ok {
+			return errInvalidQop
+		}
+	}
+	if c.Issued.Add(Lifetime.Nonce).Before(time.Now()) {
+		return errStaleNonce
+	}
+	return nil
+}
+
+// acceptNonceCount records nc and cnonce of the B-TID and nonce pair.
+// It returns false if nc is replayed or out of order.
+func acceptNonceCount(auth Authorization) (bool, error) {
+	return Store.AcceptNonceCount(auth.Username+":"+auth.Nonce, auth.Cnonce, auth.Nc,
+		time.Now().Add(Lifetime.Nonce*2))
+}
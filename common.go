@@ -3,13 +3,14 @@ package bag
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"time"
 )
 
 var (
 	qop         = []string{"auth-int"}
-	expiration  = time.Second * 10
 	productName = "bag"
+
+	// Log is called for logging of BSF and NAF
+	Log = func(...any) {}
 )
 
 func NewRandText() string {
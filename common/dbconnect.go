@@ -8,9 +8,18 @@ import (
 	"github.com/fkgi/bag"
 )
 
+// Subscriber is subscriber data in DB
+type Subscriber struct {
+	AV       bag.AV
+	SIM      bag.Triplet   // GSM triplet of SIM-only subscriber for 2G GBA
+	Digest   bag.SIPDigest // SIP Digest credential for GBA Digest
+	GUSS     []byte        // GUSS XML document
+	GUSSTime time.Time     // last update time of GUSS
+}
+
 type query struct {
 	impi string
-	ch   chan bag.AV
+	ch   chan Subscriber
 }
 
 var (
@@ -19,10 +28,10 @@ var (
 	interval = time.Second
 )
 
-func QueryDB(impi string) bag.AV {
+func QueryDB(impi string) Subscriber {
 	q := query{
 		impi: impi,
-		ch:   make(chan bag.AV, 1)}
+		ch:   make(chan Subscriber, 1)}
 	queue <- q
 	return <-q.ch
 }
@@ -45,29 +54,29 @@ func ConnectDB(path string) {
 
 		for {
 			var q query
-			var av bag.AV
+			var sub Subscriber
 
 			select {
 			case q = <-queue:
 			case <-ticker.C:
 				q.impi = ""
-				q.ch = make(chan bag.AV, 1)
+				q.ch = make(chan Subscriber, 1)
 			}
 
 			if e = enc.Encode(q.impi); e != nil {
 				Log()
 				Log("[ERR]", "read from DB RPC failed:", e)
-				q.ch <- bag.AV{}
+				q.ch <- Subscriber{}
 				break
 			}
-			if e = dec.Decode(&av); e != nil {
+			if e = dec.Decode(&sub); e != nil {
 				Log()
 				Log("[ERR]", "write to DB RPC failed:", e)
-				q.ch <- bag.AV{}
+				q.ch <- Subscriber{}
 				break
 			}
 
-			q.ch <- av
+			q.ch <- sub
 		}
 		ticker.Stop()
 		c.Close()
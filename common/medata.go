@@ -11,6 +11,8 @@ type MeReq struct {
 	RES        []byte
 	IK         []byte
 	CK         []byte
+	NextNonce  string
+	UICCKey    bool // use Ks_int_NAF of GBA_U
 	ClearCache bool
 }
 
@@ -10,14 +10,29 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/fkgi/bag"
+	"github.com/fkgi/bag/common"
 )
 
-var avs = make(chan (map[string]bag.AV), 1)
+var (
+	avs   = make(chan (map[string]bag.AV), 1)
+	gusss = make(chan (map[string]gussData), 1)
+	sims  = make(chan (map[string]bag.Triplet), 1)
+	digs  = make(chan (map[string]bag.SIPDigest), 1)
+)
+
+type gussData struct {
+	xml []byte
+	ts  time.Time
+}
 
 func init() {
 	avs <- map[string]bag.AV{}
+	gusss <- map[string]gussData{}
+	sims <- map[string]bag.Triplet{}
+	digs <- map[string]bag.SIPDigest{}
 }
 
 func main() {
@@ -61,8 +76,22 @@ func rpcHandler(c net.Conn) {
 		}
 
 		av := <-avs
-		e := enc.Encode(av[r])
+		sub := common.Subscriber{AV: av[r]}
 		avs <- av
+		gm := <-gusss
+		if g, ok := gm[r]; ok {
+			sub.GUSS = g.xml
+			sub.GUSSTime = g.ts
+		}
+		gusss <- gm
+		sm := <-sims
+		sub.SIM = sm[r]
+		sims <- sm
+		dm := <-digs
+		sub.Digest = dm[r]
+		digs <- dm
+
+		e := enc.Encode(sub)
 		if e != nil {
 			log.Println("[ERR]", "RPC answer encoding failed:", e)
 			break
@@ -96,6 +125,18 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	p := strings.Split(r.URL.Path, "/")
+	if len(p) == 3 && p[2] == "guss" {
+		gussHandler(w, r, p[1])
+		return
+	}
+	if len(p) == 3 && p[2] == "sim" {
+		simHandler(w, r, p[1])
+		return
+	}
+	if len(p) == 3 && p[2] == "digest" {
+		digestHandler(w, r, p[1])
+		return
+	}
 	if len(p) != 2 {
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte("invalid path"))
@@ -139,6 +180,12 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 			if len(av.AUTN) == 0 {
 				av.AUTN = make([]byte, 16)
 				rand.Read(av.AUTN)
+				// AMF separation bit marks GBA_U capable AV
+				if r.URL.Query().Has("gba-u") {
+					av.AUTN[6] |= bag.AMFSeparationBit
+				} else {
+					av.AUTN[6] &^= bag.AMFSeparationBit
+				}
 			}
 			if len(av.RES) == 0 {
 				av.RES = make([]byte, 16)
@@ -177,3 +224,191 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
+
+func gussHandler(w http.ResponseWriter, r *http.Request, impi string) {
+	switch r.Method {
+	case http.MethodGet:
+		gm := <-gusss
+		g, ok := gm[impi]
+		gusss <- gm
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no GUSS for IMPI: " + impi))
+		} else {
+			w.Header().Add("content-type", "application/xml")
+			w.WriteHeader(http.StatusOK)
+			w.Write(g.xml)
+		}
+
+	case http.MethodPut:
+		if data, e := io.ReadAll(r.Body); e != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(e.Error()))
+			log.Println("[ERR]", "prov fail:", "failed to read PUT GUSS for", impi, ":", e)
+		} else if _, e = bag.ParseGUSS(data); e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(e.Error()))
+			log.Println("[ERR]", "prov fail:", "failed to unmarshal GUSS for", impi, ":", e)
+		} else {
+			gm := <-gusss
+			gm[impi] = gussData{xml: data, ts: time.Now()}
+			gusss <- gm
+
+			w.Header().Add("content-type", "application/xml")
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+		}
+		r.Body.Close()
+
+	case http.MethodDelete:
+		gm := <-gusss
+		if _, ok := gm[impi]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no GUSS for IMPI: " + impi))
+		} else {
+			delete(gm, impi)
+			w.WriteHeader(http.StatusNoContent)
+		}
+		gusss <- gm
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func simHandler(w http.ResponseWriter, r *http.Request, impi string) {
+	switch r.Method {
+	case http.MethodGet:
+		sm := <-sims
+		t, ok := sm[impi]
+		sims <- sm
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no SIM triplet for IMPI: " + impi))
+		} else if data, e := json.Marshal(t); e != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(e.Error()))
+			log.Println("[ERR]", "prov fail:", "failed to marshal SIM triplet for", impi, ":", e)
+		} else {
+			w.Header().Add("content-type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+		}
+
+	case http.MethodPut:
+		var t bag.Triplet
+		if data, e := io.ReadAll(r.Body); e != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(e.Error()))
+			log.Println("[ERR]", "prov fail:", "failed to read PUT SIM triplet for", impi, ":", e)
+		} else if e = json.Unmarshal(data, &t); e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(e.Error()))
+			log.Println("[ERR]", "prov fail:", "failed to unmarshal SIM triplet for", impi, ":", e)
+		} else {
+			if len(t.RAND) == 0 {
+				t.RAND = make([]byte, 16)
+				rand.Read(t.RAND)
+			}
+			if len(t.SRES) == 0 {
+				t.SRES = make([]byte, 4)
+				rand.Read(t.SRES)
+			}
+			if len(t.Kc) == 0 {
+				t.Kc = make([]byte, 8)
+				rand.Read(t.Kc)
+			}
+			sm := <-sims
+			sm[impi] = t
+			sims <- sm
+
+			data, _ = json.Marshal(t)
+			w.Header().Add("content-type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+		}
+		r.Body.Close()
+
+	case http.MethodDelete:
+		sm := <-sims
+		if _, ok := sm[impi]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no SIM triplet for IMPI: " + impi))
+		} else {
+			delete(sm, impi)
+			w.WriteHeader(http.StatusNoContent)
+		}
+		sims <- sm
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func digestHandler(w http.ResponseWriter, r *http.Request, impi string) {
+	switch r.Method {
+	case http.MethodGet:
+		dm := <-digs
+		d, ok := dm[impi]
+		digs <- dm
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no SIP Digest credential for IMPI: " + impi))
+		} else if data, e := json.Marshal(d); e != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(e.Error()))
+			log.Println("[ERR]", "prov fail:", "failed to marshal SIP Digest credential for", impi, ":", e)
+		} else {
+			w.Header().Add("content-type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+		}
+
+	case http.MethodPut:
+		var d bag.SIPDigest
+		var pwd struct {
+			Password string `json:"password,omitempty"`
+		}
+		if data, e := io.ReadAll(r.Body); e != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(e.Error()))
+			log.Println("[ERR]", "prov fail:", "failed to read PUT SIP Digest credential for", impi, ":", e)
+		} else if e = json.Unmarshal(data, &d); e != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(e.Error()))
+			log.Println("[ERR]", "prov fail:", "failed to unmarshal SIP Digest credential for", impi, ":", e)
+		} else if json.Unmarshal(data, &pwd); d.Realm == "" ||
+			(len(d.HA1) != 16 && pwd.Password == "") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("realm and ha1 or password are required"))
+			log.Println("[ERR]", "prov fail:", "no realm, ha1 or password for", impi)
+		} else {
+			if pwd.Password != "" {
+				d.HA1 = bag.DigestHA1(impi, d.Realm, pwd.Password)
+			}
+			dm := <-digs
+			dm[impi] = d
+			digs <- dm
+
+			data, _ = json.Marshal(d)
+			w.Header().Add("content-type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(data)
+		}
+		r.Body.Close()
+
+	case http.MethodDelete:
+		dm := <-digs
+		if _, ok := dm[impi]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no SIP Digest credential for IMPI: " + impi))
+		} else {
+			delete(dm, impi)
+			w.WriteHeader(http.StatusNoContent)
+		}
+		digs <- dm
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -22,6 +22,20 @@ curl -v -X PUT http://localhost:8080/999991122223333@ims.mnc99.mcc999.3gppnetwor
 
 curl -v -X DELETE http://localhost:8080/999991122223333@ims.mnc99.mcc999.3gppnetwork.org
 
+curl -v -X PUT http://localhost:8080/999991122224444@ims.mnc99.mcc999.3gppnetwork.org/sim -d '
+{
+    "RAND":"a3c41f6b2e0d87593c1ab8e06f4d2c97",
+    "SRES":"5e1d7a20",
+    "Kc":"c2a8d94b17e06f35"
+}'
+
+curl -v -X PUT http://localhost:8080/999991122225555@ims.mnc99.mcc999.3gppnetwork.org/digest -d '
+{
+    "realm":"ims.mnc99.mcc999.3gppnetwork.org",
+    "qop":"auth,auth-int",
+    "password":"secret"
+}'
+
 
 curl -v -X PUT http://localhost:8080/999991122223333@ims.mnc99.mcc999.3gppnetwork.org -d '{}'
 
@@ -1,7 +1,9 @@
 package bag
 
 import (
+	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/fkgi/diameter"
 	"github.com/fkgi/diameter/connector"
@@ -20,7 +22,8 @@ Multimedia-Auth-Request
            [ User-Name ]          ; IMPI from UE
            [ Public-Identity ]    ; IMPU from UE, not supported
            [ SIP-Auth-Data-Item ] ; Authentication Scheme, Synchronization Failure
-           [ GUSS-Timestamp ]     ; Timestamp of GUSS in BSF, not supported
+           [ GUSS-Timestamp ]     ; Timestamp of GUSS in BSF
+           [ GBA_U-Awareness-Indicator ] ; AV with AMF separation bit for GBA_U is requested
           *[ AVP ]
           *[ Proxy-Info ]
           *[ Route-Record ]
@@ -37,7 +40,7 @@ Multimedia-Auth-Answer
            [ User-Name ]           ; IMPI, not supported
            [ Public-Identity ]     ; IMPU, not supported
            [ SIP-Auth-Data-Item ]
-           [ GBA-UserSecSettings ] ; GUSS, not supported
+           [ GBA-UserSecSettings ] ; GUSS
           *[ AVP ]
           *[ Proxy-Info ]
           *[ Route-Record ]
@@ -45,7 +48,20 @@ Multimedia-Auth-Answer
 
 var marHandler = diameter.Handle(303, 16777221, 10415, nil, connector.DefaultRouter)
 
-func MultimediaAuthRequest(name string, rand, auts []byte) (av AV, e error) {
+// AuthDataItem is authentication data in SIP-Auth-Data-Item from HSS
+type AuthDataItem struct {
+	Scheme string    // SIP-Authentication-Scheme
+	AV     AV        // AKA quintet of Digest-AKAv1-MD5
+	SIM    Triplet   // GSM triplet of 2G GBA
+	Digest SIPDigest // SIP Digest credential of GBA Digest
+}
+
+// MultimediaAuthRequest retrieves authentication data from HSS.
+// scheme is requested authentication scheme, HSS selects it if empty.
+// GUSS is returned with the time it is received if GUSS is updated after gts.
+// MAA has no GUSS-Timestamp, so the time is sent as gts in next MAR.
+// gbaU requests AV with AMF separation bit for GBA_U capable UICC.
+func MultimediaAuthRequest(name, scheme string, rand, auts []byte, gts time.Time, gbaU bool) (item AuthDataItem, guss *GUSS, nts time.Time, e error) {
 	reqavp := []diameter.AVP{
 		diameter.SetSessionID(diameter.NextSession(diameter.Host.String())),
 		diameter.SetAuthSessionState(false),
@@ -63,6 +79,14 @@ func MultimediaAuthRequest(name string, rand, auts []byte) (av AV, e error) {
 	}
 	if len(rand) == 16 && len(auts) == 14 {
 		reqavp = append(reqavp, SetSIPAuthDataItem(rand, nil, auts, nil, nil, nil))
+	} else if scheme != "" {
+		reqavp = append(reqavp, SetSIPAuthDataItemScheme(scheme))
+	}
+	if !gts.IsZero() {
+		reqavp = append(reqavp, SetGUSSTimestamp(gts))
+	}
+	if gbaU {
+		reqavp = append(reqavp, SetGBAUAwarenessIndicator(true))
 	}
 	_, avps := marHandler(false, reqavp)
 
@@ -89,9 +113,18 @@ func MultimediaAuthRequest(name string, rand, auts []byte) (av AV, e error) {
 			// Public-Identity
 		case 612:
 			// SIP-Auth-Data-Item
-			av.RAND, av.AUTN, _, av.RES, av.CK, av.IK, e = GetSIPAuthDataItem(a)
+			if item.Scheme, e = GetSIPAuthenticationScheme(a); e != nil {
+			} else if item.Scheme == Scheme2GGBA {
+				item.SIM, e = GetSIPAuthDataItem2G(a)
+			} else if item.Scheme == SchemeSIPDigest {
+				item.Digest, e = GetSIPAuthDataItemDigest(a)
+			} else {
+				av := &item.AV
+				av.RAND, av.AUTN, _, av.RES, av.CK, av.IK, e = GetSIPAuthDataItem(a)
+			}
 		case 400:
 			// GBA-UserSecSettings
+			guss, e = GetGBAUserSecSettings(a)
 		case 284:
 			// Proxy-Info
 		case 282:
@@ -102,8 +135,28 @@ func MultimediaAuthRequest(name string, rand, auts []byte) (av AV, e error) {
 		}
 	}
 
+	if guss != nil {
+		nts = time.Now().UTC()
+	}
+	av, sim, dig := item.AV, item.SIM, item.Digest
 	if result != diameter.Success {
 		e = fmt.Errorf("failed result %d from HSS", result)
+	} else if scheme != "" && item.Scheme != scheme {
+		e = fmt.Errorf("unexpected authentication scheme %s from HSS", item.Scheme)
+	} else if item.Scheme == Scheme2GGBA {
+		if len(sim.RAND) != 16 {
+			e = fmt.Errorf("invalid RAND from HSS")
+		} else if len(sim.SRES) != 4 {
+			e = fmt.Errorf("invalid SRES from HSS")
+		} else if len(sim.Kc) != 8 {
+			e = fmt.Errorf("invalid Kc from HSS")
+		}
+	} else if item.Scheme == SchemeSIPDigest {
+		if dig.Realm == "" {
+			e = fmt.Errorf("no Digest-Realm from HSS")
+		} else if len(dig.HA1) != 16 {
+			e = fmt.Errorf("invalid Digest-HA1 from HSS")
+		}
 	} else if len(av.RAND) != 16 {
 		e = fmt.Errorf("invalid RAND from HSS")
 	} else if len(av.AUTN) != 16 {
@@ -121,13 +174,13 @@ func MultimediaAuthRequest(name string, rand, auts []byte) (av AV, e error) {
 /*
 SIP-Auth-Data-Item :: = < AVP Header : 612 10415 >
       [ SIP-Item-Number ]            ; not supported
-      [ SIP-Authentication-Scheme ]  ; not supported, only "Digest-AKAv1-MD5"
-      [ SIP-Authenticate ]           ; RAND+AUTN, response only
-      [ SIP-Authorization ]          ; RAND+AUTS (request) or XRES (response)
+      [ SIP-Authentication-Scheme ]  ; "Digest-AKAv1-MD5" or 2G GBA scheme
+      [ SIP-Authenticate ]           ; RAND+AUTN or RAND for 2G GBA, response only
+      [ SIP-Authorization ]          ; RAND+AUTS (request), XRES or SRES for 2G GBA (response)
       [ SIP-Authentication-Context ] ; not supported
-      [ Confidentiality-Key ]        ; CK, response only
+      [ Confidentiality-Key ]        ; CK or Kc for 2G GBA, response only
       [ Integrity-Key ]              ; IK, response only
-      [ SIP-Digest-Authenticate ]    ; not supported
+      [ SIP-Digest-Authenticate ]    ; H(A1) for GBA Digest, response only
       [ Framed-IP-Address ]          ; not supported
       [ Framed-IPv6-Prefix ]         ; not supported
       [ Framed-Interface-Id ]        ; not supported
@@ -135,6 +188,25 @@ SIP-Auth-Data-Item :: = < AVP Header : 612 10415 >
     * [AVP]
 */
 
+// SIP-Authentication-Scheme values
+const (
+	SchemeAKAv1MD5  = "Digest-AKAv1-MD5" // AKA quintet for 3G GBA
+	SchemeSIPDigest = "SIP Digest"       // SIP Digest credential for GBA Digest
+)
+
+// Scheme2GGBA is SIP-Authentication-Scheme of GSM triplet for 2G GBA.
+// Zh does not define the value, so it must be same as the one of HSS.
+var Scheme2GGBA = "GBA-2G"
+
+// SetSIPAuthDataItemScheme make SIP-Auth-Data-Item AVP of MAR to request the scheme
+func SetSIPAuthDataItemScheme(scheme string) (a diameter.AVP) {
+	s := diameter.AVP{Code: 608, VendorID: 10415, Mandatory: true}
+	s.Encode(scheme)
+	a = diameter.AVP{Code: 612, VendorID: 10415, Mandatory: true}
+	a.Encode([]diameter.AVP{s})
+	return
+}
+
 // SetSIPAuthDataItem make SIP-Auth-Data-Item AVP
 func SetSIPAuthDataItem(rand, autn, auts, xres, ck, ik []byte) (a diameter.AVP) {
 	v := []diameter.AVP{}
@@ -144,7 +216,7 @@ func SetSIPAuthDataItem(rand, autn, auts, xres, ck, ik []byte) (a diameter.AVP)
 	// SIP-Authentication-Scheme
 	if len(xres) == 16 {
 		a := diameter.AVP{Code: 608, VendorID: 10415, Mandatory: true}
-		a.Encode("Digest-AKAv1-MD5")
+		a.Encode(SchemeAKAv1MD5)
 		v = append(v, a)
 	}
 
@@ -271,7 +343,201 @@ func GetSIPAuthDataItem(a diameter.AVP) (rand, autn, auts, xres, ck, ik []byte,
 	return
 }
 
-// GUSS-Timestamp
+// SetSIPAuthDataItem2G make SIP-Auth-Data-Item AVP with GSM triplet
+func SetSIPAuthDataItem2G(t Triplet) (a diameter.AVP) {
+	v := []diameter.AVP{}
+
+	// SIP-Authentication-Scheme
+	a = diameter.AVP{Code: 608, VendorID: 10415, Mandatory: true}
+	a.Encode(Scheme2GGBA)
+	v = append(v, a)
+
+	// SIP-Authenticate
+	a = diameter.AVP{Code: 609, VendorID: 10415, Mandatory: true}
+	a.Encode(t.RAND)
+	v = append(v, a)
+
+	// SIP-Authorization
+	a = diameter.AVP{Code: 610, VendorID: 10415, Mandatory: true}
+	a.Encode(t.SRES)
+	v = append(v, a)
+
+	// Confidentiality-Key
+	a = diameter.AVP{Code: 625, VendorID: 10415, Mandatory: true}
+	a.Encode(t.Kc)
+	v = append(v, a)
+
+	a = diameter.AVP{Code: 612, VendorID: 10415, Mandatory: true}
+	a.Encode(v)
+	return
+}
+
+// GetSIPAuthDataItem2G read SIP-Auth-Data-Item AVP with GSM triplet
+func GetSIPAuthDataItem2G(a diameter.AVP) (t Triplet, e error) {
+	o := []diameter.AVP{}
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+		return
+	}
+	if e = a.Decode(&o); e != nil {
+		return
+	}
+	for _, a := range o {
+		var v *[]byte
+		var l int
+		switch a.Code {
+		case 609:
+			// SIP-Authenticate
+			v, l = &t.RAND, 16
+		case 610:
+			// SIP-Authorization
+			v, l = &t.SRES, 4
+		case 625:
+			// Confidentiality-Key
+			v, l = &t.Kc, 8
+		default:
+			continue
+		}
+		if a.VendorID != 10415 || !a.Mandatory {
+			e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+		} else if e = a.Decode(v); e != nil {
+		} else if len(*v) != l {
+			e = diameter.InvalidAVP{Code: diameter.InvalidAvpValue, AVP: a}
+		}
+		if e != nil {
+			break
+		}
+	}
+	return
+}
+
+/*
+SIP-Digest-Authenticate ::= < AVP Header: 635 10415 >
+      { Digest-Realm }     ; AVP code 104
+      [ Digest-Algorithm ] ; AVP code 111
+      [ Digest-QoP ]       ; AVP code 110
+      [ Digest-HA1 ]       ; AVP code 121, hex H(A1)
+    * [ AVP ]
+*/
+
+// SetSIPAuthDataItemDigest make SIP-Auth-Data-Item AVP with SIP Digest credential
+func SetSIPAuthDataItemDigest(d SIPDigest) (a diameter.AVP) {
+	v := []diameter.AVP{}
+
+	// SIP-Authentication-Scheme
+	a = diameter.AVP{Code: 608, VendorID: 10415, Mandatory: true}
+	a.Encode(SchemeSIPDigest)
+	v = append(v, a)
+
+	// SIP-Digest-Authenticate
+	da := []diameter.AVP{}
+	a = diameter.AVP{Code: 104, Mandatory: true}
+	a.Encode(d.Realm)
+	da = append(da, a)
+	if d.Algorithm != "" {
+		a = diameter.AVP{Code: 111, Mandatory: true}
+		a.Encode(d.Algorithm)
+		da = append(da, a)
+	}
+	if d.QoP != "" {
+		a = diameter.AVP{Code: 110, Mandatory: true}
+		a.Encode(d.QoP)
+		da = append(da, a)
+	}
+	a = diameter.AVP{Code: 121, Mandatory: true}
+	a.Encode(hex.EncodeToString(d.HA1))
+	da = append(da, a)
+
+	a = diameter.AVP{Code: 635, VendorID: 10415, Mandatory: true}
+	a.Encode(da)
+	v = append(v, a)
+
+	a = diameter.AVP{Code: 612, VendorID: 10415, Mandatory: true}
+	a.Encode(v)
+	return
+}
+
+// GetSIPAuthDataItemDigest read SIP-Auth-Data-Item AVP with SIP Digest credential
+func GetSIPAuthDataItemDigest(a diameter.AVP) (d SIPDigest, e error) {
+	o := []diameter.AVP{}
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+		return
+	}
+	if e = a.Decode(&o); e != nil {
+		return
+	}
+	for _, a := range o {
+		if a.Code != 635 {
+			continue
+		}
+		// SIP-Digest-Authenticate
+		da := []diameter.AVP{}
+		if a.VendorID != 10415 || !a.Mandatory {
+			e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+			return
+		}
+		if e = a.Decode(&da); e != nil {
+			return
+		}
+		for _, a := range da {
+			switch a.Code {
+			case 104:
+				// Digest-Realm
+				e = a.Decode(&d.Realm)
+			case 111:
+				// Digest-Algorithm
+				e = a.Decode(&d.Algorithm)
+			case 110:
+				// Digest-QoP
+				e = a.Decode(&d.QoP)
+			case 121:
+				// Digest-HA1
+				var h string
+				if e = a.Decode(&h); e != nil {
+				} else if d.HA1, e = hex.DecodeString(h); e != nil || len(d.HA1) != 16 {
+					e = diameter.InvalidAVP{Code: diameter.InvalidAvpValue, AVP: a}
+				}
+			}
+			if e != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// GetSIPAuthenticationScheme read SIP-Authentication-Scheme in SIP-Auth-Data-Item AVP
+func GetSIPAuthenticationScheme(a diameter.AVP) (s string, e error) {
+	o := []diameter.AVP{}
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+		return
+	}
+	if e = a.Decode(&o); e != nil {
+		return
+	}
+	for _, a := range o {
+		if a.Code == 608 {
+			e = a.Decode(&s)
+			break
+		}
+	}
+	return
+}
+
+// SetGUSSTimestamp make GUSS-Timestamp AVP
+func SetGUSSTimestamp(t time.Time) diameter.AVP {
+	return setTimeAVP(409, t)
+}
+
+// GetGUSSTimestamp read GUSS-Timestamp AVP
+func GetGUSSTimestamp(a diameter.AVP) (time.Time, error) {
+	return getTimeAVP(a)
+}
 
 // IdentityUnknown Diameter response code
 const IdentityUnknown uint32 = 10415*10000 + 5401
+
+// AuthSchemeNotSupported Diameter response code
+const AuthSchemeNotSupported uint32 = 10415*10000 + 5006
@@ -0,0 +1,92 @@
+package bag
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// SIPDigest is SIP Digest credential in SIP-Digest-Authenticate for GBA Digest
+type SIPDigest struct {
+	Realm     string // Digest-Realm
+	Algorithm string // Digest-Algorithm, MD5 if empty
+	QoP       string // Digest-QoP
+	HA1       []byte // Digest-HA1, H(A1) = MD5(IMPI:realm:password)
+}
+
+func (d *SIPDigest) UnmarshalJSON(b []byte) (e error) {
+	var tmp struct {
+		Realm     string `json:"realm,omitempty"`
+		Algorithm string `json:"algorithm,omitempty"`
+		QoP       string `json:"qop,omitempty"`
+		HA1       string `json:"ha1,omitempty"`
+	}
+
+	if e = json.Unmarshal(b, &tmp); e != nil {
+		return
+	}
+	d.Realm = tmp.Realm
+	d.Algorithm = tmp.Algorithm
+	d.QoP = tmp.QoP
+	d.HA1, e = hex.DecodeString(tmp.HA1)
+	return
+}
+
+func (d SIPDigest) MarshalJSON() (b []byte, e error) {
+	type tmp struct {
+		Realm     string `json:"realm,omitempty"`
+		Algorithm string `json:"algorithm,omitempty"`
+		QoP       string `json:"qop,omitempty"`
+		HA1       string `json:"ha1,omitempty"`
+	}
+	return json.Marshal(tmp{
+		Realm:     d.Realm,
+		Algorithm: d.Algorithm,
+		QoP:       d.QoP,
+		HA1:       hex.EncodeToString(d.HA1)})
+}
+
+func (d SIPDigest) String() string {
+	return fmt.Sprintf("SIP Digest realm=%s, algorithm=%s, qop=%s, H(A1)=%x",
+		d.Realm, d.Algorithm, d.QoP, d.HA1)
+}
+
+// DigestHA1 returns H(A1) of the password defined in RFC 2617
+func DigestHA1(username, realm, password string) []byte {
+	h := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return h[:]
+}
+
+// P0 value of Ks derivation of GBA Digest
+const LabelDigestKs = "GBA_Digest_Ks"
+
+// DigestProductToken is User-Agent product token of UE supporting GBA Digest
+const DigestProductToken = "3gpp-gba-digest"
+
+// AV returns AV of GBA Digest bootstrap defined in TS 33.220 Annex M.
+// AUTN of the AV is server data in the nonce, RES is H(A1) and
+// CK || IK is Ks = KDF(H(A1), "GBA_Digest_Ks", RAND).
+// So the nonce is RAND || server data and B-TID is made from RAND as same as AKA.
+func (d SIPDigest) AV(rand, sd []byte, impi string) (av AV, e error) {
+	if len(d.HA1) != 16 || len(rand) != 16 || len(sd) != 16 {
+		e = fmt.Errorf("invalid length of H(A1), RAND or server data")
+		return
+	}
+	if d.Algorithm != "" && d.Algorithm != "MD5" {
+		e = fmt.Errorf("unsupported digest algorithm %s", d.Algorithm)
+		return
+	}
+	ks, e := KDF(d.HA1, FCGBA, KDFParam(LabelDigestKs), KDFParam(rand))
+	if e != nil {
+		return
+	}
+	av = AV{
+		RAND: rand,
+		AUTN: sd,
+		RES:  d.HA1,
+		CK:   ks[:16],
+		IK:   ks[16:],
+		IMPI: impi}
+	return
+}
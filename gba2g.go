@@ -0,0 +1,85 @@
+package bag
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// Triplet is GSM authentication triplet of SIM for 2G GBA
+type Triplet struct {
+	RAND []byte // 128 bit GSM RAND
+	SRES []byte // 32 bit SRES
+	Kc   []byte // 64 bit Kc
+}
+
+func (t *Triplet) UnmarshalJSON(b []byte) (e error) {
+	var tmp struct {
+		RAND string `json:"RAND,omitempty"`
+		SRES string `json:"SRES,omitempty"`
+		Kc   string `json:"Kc,omitempty"`
+	}
+
+	if e = json.Unmarshal(b, &tmp); e != nil {
+		return
+	}
+	if t.RAND, e = hex.DecodeString(tmp.RAND); e != nil {
+		return
+	}
+	if t.SRES, e = hex.DecodeString(tmp.SRES); e != nil {
+		return
+	}
+	t.Kc, e = hex.DecodeString(tmp.Kc)
+	return
+}
+
+func (t Triplet) MarshalJSON() (b []byte, e error) {
+	type tmp struct {
+		RAND string `json:"RAND,omitempty"`
+		SRES string `json:"SRES,omitempty"`
+		Kc   string `json:"Kc,omitempty"`
+	}
+	return json.Marshal(tmp{
+		RAND: hex.EncodeToString(t.RAND),
+		SRES: hex.EncodeToString(t.SRES),
+		Kc:   hex.EncodeToString(t.Kc)})
+}
+
+func (t Triplet) String() string {
+	return fmt.Sprintf("triplet RAND=%x, SRES=%x, Kc=%x", t.RAND, t.SRES, t.Kc)
+}
+
+// P1 values of Ks and RES derivation of 2G GBA
+const (
+	Label2GKs  = "3gpp-gba-ks"
+	Label2GRES = "3gpp-gba-res"
+)
+
+// AV returns AV of 2G GBA bootstrap defined in TS 33.220 Annex I.
+// AUTN of the AV is Ks-input, RES is Trunc(KDF(key, "3gpp-gba-res", SRES)) and
+// CK || IK is Ks = KDF(key, Ks-input, "3gpp-gba-ks", SRES), where key = Kc || Kc || RAND.
+// So the nonce is RAND || Ks-input and Ks_NAF is derived as same as GBA_ME.
+func (t Triplet) AV(ksInput []byte, impi string) (av AV, e error) {
+	if len(t.RAND) != 16 || len(t.SRES) != 4 || len(t.Kc) != 8 || len(ksInput) != 16 {
+		e = fmt.Errorf("invalid length of triplet or Ks-input")
+		return
+	}
+	key := append(append(append(make([]byte, 0, 32), t.Kc...), t.Kc...), t.RAND...)
+
+	ks, e := KDF(key, FCGBA, KDFParam(ksInput), KDFParam(Label2GKs), KDFParam(t.SRES))
+	if e != nil {
+		return
+	}
+	res, e := KDF(key, FCGBA, KDFParam(Label2GRES), KDFParam(t.SRES))
+	if e != nil {
+		return
+	}
+	av = AV{
+		RAND: t.RAND,
+		AUTN: ksInput,
+		RES:  res[:16],
+		CK:   ks[:16],
+		IK:   ks[16:],
+		IMPI: impi}
+	return
+}
@@ -0,0 +1,76 @@
+package bag
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+)
+
+// GBAType is bootstrapping type of the session
+type GBAType int
+
+const (
+	GBAME     GBAType = iota // GBA_ME, keys are derived in ME
+	GBAU                     // GBA_U, keys are derived in UICC
+	GBA2G                    // 2G GBA with SIM, defined in TS 33.220 Annex I
+	GBADigest                // GBA Digest with SIP Digest credential, defined in TS 33.220 Annex M
+)
+
+var gbaTypeNames = map[GBAType]string{
+	GBAME:     "GBA_ME",
+	GBAU:      "GBA_U",
+	GBA2G:     "2G_GBA",
+	GBADigest: "GBA_Digest",
+}
+
+func (t GBAType) String() string {
+	if s, ok := gbaTypeNames[t]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// ParseGBAType returns GBAType of the name
+func ParseGBAType(s string) (GBAType, error) {
+	for t, n := range gbaTypeNames {
+		if n == s {
+			return t, nil
+		}
+	}
+	return GBAME, fmt.Errorf("unknown GBA type %s", s)
+}
+
+// UICCProductToken is User-Agent product token of ME with GBA_U capable UICC defined in TS 24.109
+const UICCProductToken = "3gpp-gba-uicc"
+
+// HasProductToken returns true if the User-Agent or Server header has the product token
+func HasProductToken(ua, token string) bool {
+	for _, p := range strings.Fields(ua) {
+		if p == token || strings.HasPrefix(p, token+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// AMFSeparationBit is bit 0 of AMF in AUTN, set in AV that UICC may use for GBA_U
+const AMFSeparationBit byte = 0x80
+
+// GBAUCapable returns true if AMF separation bit of the AUTN is set
+func GBAUCapable(autn []byte) bool {
+	return len(autn) == 16 && autn[6]&AMFSeparationBit != 0
+}
+
+// GBAUAUTN returns AUTN* = SQN xor AK || AMF || MAC* of GBA_U defined in TS 33.220,
+// where MAC* = MAC xor Trunc(SHA-1(IK)). The UICC gets AUTN from AUTN* in the same way.
+func GBAUAUTN(autn, ik []byte) []byte {
+	ret := append([]byte{}, autn...)
+	if len(ret) != 16 {
+		return ret
+	}
+	h := sha1.Sum(ik)
+	for i := 0; i < 8; i++ {
+		ret[8+i] ^= h[i]
+	}
+	return ret
+}
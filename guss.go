@@ -0,0 +1,191 @@
+package bag
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fkgi/diameter"
+)
+
+/*
+GBA User Security Settings defined in TS 29.109 Annex A
+
+	<guss xmlns="uri:3gpp-gba" id="...">
+	  <BsfInfo>
+	    <uiccType>GBA</uiccType>
+	    <lifeTime>3600</lifeTime>
+	  </BsfInfo>
+	  <UssList>
+	    <uss id="1" type="1" nafGroup="..." uiccSecurityType="GBA">
+	      <uids><uid>sip:...</uid></uids>
+	      <flags><flag>1</flag></flags>
+	    </uss>
+	  </UssList>
+	</guss>
+*/
+
+// GUSS is GBA User Security Settings of the subscriber
+type GUSS struct {
+	ID          string
+	UICCType    string        // GBA or GBA_U
+	KeyLifetime time.Duration // lifetime of the key, zero if not specified
+	USSList     []USS
+}
+
+// USS is User Security Settings for the GAA application
+type USS struct {
+	ID               string
+	Type             int      // GAA application type
+	NAFGroup         string   // NAF group of the USS
+	UICCSecurityType string   // GBA, GBA_U or GBA_ME
+	UIDs             []string // IMPUs of the subscriber
+	Flags            []int    // authorization flags
+}
+
+type gussXML struct {
+	XMLName xml.Name `xml:"uri:3gpp-gba guss"`
+	ID      string   `xml:"id,attr,omitempty"`
+	BsfInfo struct {
+		UICCType string `xml:"uiccType,omitempty"`
+		LifeTime int64  `xml:"lifeTime,omitempty"`
+	} `xml:"BsfInfo"`
+	USSList []ussXML `xml:"UssList>uss"`
+}
+
+type ussXML struct {
+	ID               string   `xml:"id,attr"`
+	Type             int      `xml:"type,attr"`
+	NAFGroup         string   `xml:"nafGroup,attr,omitempty"`
+	UICCSecurityType string   `xml:"uiccSecurityType,attr,omitempty"`
+	UIDs             []string `xml:"uids>uid"`
+	Flags            []int    `xml:"flags>flag,omitempty"`
+}
+
+func (g GUSS) MarshalXML(e *xml.Encoder, s xml.StartElement) error {
+	tmp := gussXML{ID: g.ID}
+	tmp.BsfInfo.UICCType = g.UICCType
+	tmp.BsfInfo.LifeTime = int64(g.KeyLifetime / time.Second)
+	for _, u := range g.USSList {
+		tmp.USSList = append(tmp.USSList, ussXML{
+			ID:               u.ID,
+			Type:             u.Type,
+			NAFGroup:         u.NAFGroup,
+			UICCSecurityType: u.UICCSecurityType,
+			UIDs:             u.UIDs,
+			Flags:            u.Flags})
+	}
+	return e.Encode(tmp)
+}
+
+func (g *GUSS) UnmarshalXML(d *xml.Decoder, s xml.StartElement) (e error) {
+	tmp := gussXML{}
+	if e = d.DecodeElement(&tmp, &s); e != nil {
+		return
+	}
+	if tmp.XMLName.Space != "uri:3gpp-gba" {
+		return fmt.Errorf("invalid GUSS namespace %s", tmp.XMLName.Space)
+	}
+	if tmp.BsfInfo.LifeTime < 0 {
+		return fmt.Errorf("invalid GUSS lifeTime %d", tmp.BsfInfo.LifeTime)
+	}
+	g.ID = tmp.ID
+	g.UICCType = tmp.BsfInfo.UICCType
+	g.KeyLifetime = time.Duration(tmp.BsfInfo.LifeTime) * time.Second
+	g.USSList = make([]USS, len(tmp.USSList))
+	for i, u := range tmp.USSList {
+		g.USSList[i] = USS{
+			ID:               u.ID,
+			Type:             u.Type,
+			NAFGroup:         u.NAFGroup,
+			UICCSecurityType: u.UICCSecurityType,
+			UIDs:             u.UIDs,
+			Flags:            u.Flags}
+	}
+	return
+}
+
+// ParseGUSS parse GUSS XML document
+func ParseGUSS(b []byte) (g *GUSS, e error) {
+	g = new(GUSS)
+	if e = xml.Unmarshal(b, g); e != nil {
+		g = nil
+	}
+	return
+}
+
+// IMPUs returns all IMPUs in the USS list
+func (g *GUSS) IMPUs() []string {
+	ret := []string{}
+	if g == nil {
+		return ret
+	}
+	for _, u := range g.USSList {
+		ret = append(ret, u.UIDs...)
+	}
+	return ret
+}
+
+func (g GUSS) String() string {
+	buf := new(strings.Builder)
+	fmt.Fprintf(buf, "GUSS %s, UICC type=%s, lifetime=%s", g.ID, g.UICCType, g.KeyLifetime)
+	for _, u := range g.USSList {
+		fmt.Fprintf(buf, ", USS %s(type=%d, group=%s, uids=%v, flags=%v)",
+			u.ID, u.Type, u.NAFGroup, u.UIDs, u.Flags)
+	}
+	return buf.String()
+}
+
+// SetGBAUserSecSettings make GBA-UserSecSettings AVP
+func SetGBAUserSecSettings(g *GUSS) (a diameter.AVP) {
+	b, _ := xml.Marshal(g)
+	a = diameter.AVP{Code: 400, VendorID: 10415, Mandatory: true}
+	a.Encode(b)
+	return
+}
+
+// GetGBAUserSecSettings read GBA-UserSecSettings AVP
+func GetGBAUserSecSettings(a diameter.AVP) (g *GUSS, e error) {
+	var b []byte
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+	} else if e = a.Decode(&b); e != nil {
+	} else if g, e = ParseGUSS(b); e != nil {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpValue, AVP: a, E: e}
+	}
+	return
+}
+
+// GUSS cache of the IMPI in BSF with the time it is received from HSS
+var gussExpiration = time.Hour * 24
+
+func getCachedGUSS(impi string) (g *GUSS, ts time.Time, e error) {
+	data, ttl, e := Store.Get("guss:" + impi)
+	if e != nil || ttl.IsZero() {
+		return
+	}
+	t := strings.SplitN(string(data), ":", 2)
+	if len(t) != 2 {
+		e = fmt.Errorf("invalid data")
+	} else if i, err := strconv.ParseInt(t[0], 10, 64); err != nil {
+		e = fmt.Errorf("invalid data")
+	} else if b, err := base64.StdEncoding.DecodeString(t[1]); err != nil {
+		e = fmt.Errorf("invalid data")
+	} else if g, e = ParseGUSS(b); e == nil {
+		ts = time.Unix(i, 0).UTC()
+	}
+	return
+}
+
+func setCachedGUSS(impi string, g *GUSS, ts time.Time) error {
+	b, e := xml.Marshal(g)
+	if e != nil {
+		return e
+	}
+	return Store.Set("guss:"+impi,
+		[]byte(strconv.FormatInt(ts.Unix(), 10)+":"+base64.StdEncoding.EncodeToString(b)),
+		time.Now().Add(gussExpiration))
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"log"
+	"time"
 
 	"github.com/fkgi/bag"
 	"github.com/fkgi/bag/common"
@@ -11,7 +12,10 @@ import (
 
 func marHandler(retry bool, avps []diameter.AVP) (bool, []diameter.AVP) {
 	var impi string
+	var scheme string
+	var gbaU bool
 	var session string
+	var gts time.Time
 	var e error
 	for _, avp := range avps {
 		switch avp.Code {
@@ -35,7 +39,11 @@ func marHandler(retry bool, avps []diameter.AVP) (bool, []diameter.AVP) {
 			}
 		case 601: // Public-Identity
 		case 612: // SIP-Auth-Data-Item
+			scheme, e = bag.GetSIPAuthenticationScheme(avp)
 		case 409: // GUSS-Timestamp
+			gts, e = bag.GetGUSSTimestamp(avp)
+		case 407: // GBA_U-Awareness-Indicator
+			gbaU, e = bag.GetGBAUAwarenessIndicator(avp)
 		case 284: // Proxy-Info
 		case 282: // Route-Record
 		default:
@@ -50,6 +58,7 @@ func marHandler(retry bool, avps []diameter.AVP) (bool, []diameter.AVP) {
 
 	result := diameter.Success
 	auth := diameter.AVP{}
+	var guss *bag.GUSS
 
 	if iavp, ok := e.(diameter.InvalidAVP); ok {
 		result = iavp.Code
@@ -59,11 +68,40 @@ func marHandler(retry bool, avps []diameter.AVP) (bool, []diameter.AVP) {
 	} else if len(session) == 0 {
 		result = diameter.MissingAvp
 		e = diameter.InvalidAVP{Code: result, AVP: diameter.SetSessionID("")}
-	} else if av := common.QueryDB(impi); len(av.RAND) == 0 {
+	} else if sub := common.QueryDB(impi); len(sub.AV.RAND) == 0 &&
+		len(sub.SIM.RAND) == 0 && len(sub.Digest.HA1) == 0 {
 		result = bag.IdentityUnknown
 		e = errors.New("identity not found")
+	} else if scheme == bag.SchemeSIPDigest && len(sub.Digest.HA1) == 0 {
+		result = bag.AuthSchemeNotSupported
+		e = errors.New("no SIP Digest credential")
+	} else if scheme == bag.SchemeAKAv1MD5 && len(sub.AV.RAND) == 0 {
+		result = bag.AuthSchemeNotSupported
+		e = errors.New("no AKA credential")
+	} else if scheme == bag.Scheme2GGBA && len(sub.SIM.RAND) == 0 {
+		result = bag.AuthSchemeNotSupported
+		e = errors.New("no GSM triplet")
+	} else if scheme != "" && scheme != bag.SchemeAKAv1MD5 &&
+		scheme != bag.Scheme2GGBA && scheme != bag.SchemeSIPDigest {
+		result = bag.AuthSchemeNotSupported
+		e = errors.New("unknown authentication scheme " + scheme)
 	} else {
-		auth = bag.SetSIPAuthDataItem(av.RAND, av.AUTN, nil, av.RES, av.CK, av.IK)
+		if av := sub.AV; (scheme == "" || scheme == bag.SchemeAKAv1MD5) && len(av.RAND) != 0 {
+			auth = bag.SetSIPAuthDataItem(av.RAND, av.AUTN, nil, av.RES, av.CK, av.IK)
+			if gbaU && !bag.GBAUCapable(av.AUTN) && *verbose {
+				log.Println("[INFO]", "no GBA_U capable AV with AMF separation bit for", impi)
+			}
+		} else if (scheme == "" || scheme == bag.Scheme2GGBA) && len(sub.SIM.RAND) != 0 {
+			auth = bag.SetSIPAuthDataItem2G(sub.SIM)
+		} else {
+			auth = bag.SetSIPAuthDataItemDigest(sub.Digest)
+		}
+		if len(sub.GUSS) != 0 && (gts.IsZero() || sub.GUSSTime.Unix() > gts.Unix()) {
+			if guss, e = bag.ParseGUSS(sub.GUSS); e != nil {
+				log.Println("[ERR]", "invalid GUSS for", impi, ":", e)
+				guss = nil
+			}
+		}
 	}
 
 	res := []diameter.AVP{}
@@ -82,6 +120,9 @@ func marHandler(retry bool, avps []diameter.AVP) (bool, []diameter.AVP) {
 		res = append(res,
 			auth,
 			diameter.SetUserName(impi))
+		if guss != nil {
+			res = append(res, bag.SetGBAUserSecSettings(guss))
+		}
 		if *verbose {
 			log.Println("[INFO]", "MAR handling for", impi, "success")
 		}
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/fkgi/bag"
 	"github.com/fkgi/bag/common"
 	"github.com/fkgi/diameter"
 	"github.com/fkgi/diameter/connector"
@@ -29,6 +30,8 @@ func main() {
 	dp := flag.String("diameter-peer", "",
 		"DIAMETER peer host for dial with format as same as -diameter-local")
 	db := flag.String("db", "localhost:6636", "DB RPC remote host:port")
+	flag.StringVar(&bag.Scheme2GGBA, "scheme-2g", bag.Scheme2GGBA,
+		"SIP-Authentication-Scheme of GSM triplet for 2G GBA")
 	verbose = flag.Bool("verbose", false, "verbose log mode")
 	flag.Parse()
 
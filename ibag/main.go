@@ -2,14 +2,19 @@ package main
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fkgi/bag"
 	"github.com/fkgi/diameter"
@@ -23,10 +28,181 @@ func main() {
 	nl := flag.String("naf-local", "", "NAF local IP address")
 	cr := flag.String("crt", "", "TLS crt file")
 	ky := flag.String("key", "", "TLS key file")
+	zn := flag.String("zn", "local",
+		"Zn reference point for NAF, local (run BSF in this process), diameter or HTTP URL of remote BSF")
+	za := flag.String("zn-api", "", "HTTPS/JSON Zn API local address with format [host]:port")
+	zc := flag.String("zn-ca", "",
+		"CA certificate file of Zn API, verifies NAF client certificate in BSF and BSF server certificate in NAF")
+	flag.StringVar(&bag.Scheme2GGBA, "scheme-2g", bag.Scheme2GGBA,
+		"SIP-Authentication-Scheme of GSM triplet for 2G GBA in Zh, same as the one of HSS")
+	ra := flag.String("revoke-api", "", "HTTPS revocation API local address with format [host]:port")
+	rc := flag.String("revoke-ca", "", "CA certificate file of revocation API, verifies client certificate")
+	flag.BoolVar(&bag.NAFKeyCache, "naf-key-cache", false,
+		"cache Ks_NAF in NAF and drop it on revocation notified through the session store")
+	as := flag.String("assert", bag.IdentityAssertion.String(),
+		"X-3GPP-Asserted-Identity mode of NAF, none, intended, intended-guss or guss")
+	up := flag.String("upstream", "", "HTTP URL of backend application server for NAF")
+	rf := flag.String("routes", "", "JSON file of NAF route table and policy")
+	bt := flag.String("btid", "rand", "B-TID format of BSF, rand (base64(RAND)@BSF) or hash")
+	ck := flag.String("challenge-key", "",
+		"hex AES key for stateless BSF challenge, share it among BSF instances")
+	sp := flag.String("store", "redis://localhost:6379",
+		"session store of BSF and NAF, memory (in this process) or redis[s]://[user:password@]host:port[/db][?protocol=3]")
+	pool := flag.Int("store-pool", bag.DefaultPoolSize, "connection pool size of Redis session store")
+	stt := flag.Duration("store-timeout", time.Second*3, "timeout of each Redis session store access")
+	sts := flag.String("store-sentinels", "",
+		"comma separated Sentinel host:port to discover master, host of -store is master name")
+	stc := flag.Bool("store-cluster", false, "Redis Cluster mode, host of -store is seed node")
+	kek := flag.String("store-kek", "",
+		"comma separated hex AES key-encryption keys of session with format id=key, first one is used for sealing")
+	ree := flag.Bool("reencrypt", false, "re-encrypt all sessions in the store with the first -store-kek and exit")
+	bd := flag.String("bsf-domain", "", "comma separated acceptable BSF domain names in B-TID for NAF")
+	flag.DurationVar(&bag.Lifetime.Default, "lifetime", bag.Lifetime.Default,
+		"default lifetime of bootstrapping session")
+	lr := flag.String("lifetime-realm", "",
+		"comma separated lifetime of bootstrapping session for IMPI realm with format realm=duration")
+	flag.BoolVar(&bag.Lifetime.GUSS, "lifetime-guss", false,
+		"use key lifetime in GUSS for bootstrapping session")
+	flag.DurationVar(&bag.Lifetime.KsNAF, "lifetime-ksnaf", 0,
+		"lifetime of Ks_NAF from boot time, 0 for same as bootstrapping session")
+	flag.DurationVar(&bag.Lifetime.Nonce, "lifetime-nonce", bag.Lifetime.Nonce,
+		"lifetime of nonce in BSF and NAF challenge")
 	flag.Parse()
 
+	switch *bt {
+	case "rand":
+		bag.BTIDGen = bag.RandBTID{}
+	case "hash":
+		bag.BTIDGen = bag.HashBTID{}
+	default:
+		log.Fatalln("invalid B-TID format:", *bt)
+	}
+	if *ck != "" {
+		k, e := hex.DecodeString(*ck)
+		if e != nil || (len(k) != 16 && len(k) != 24 && len(k) != 32) {
+			log.Fatalln("invalid challenge key, 16, 24 or 32 octets hex is required")
+		}
+		bag.ChallengeKey = k
+	}
+	if *sp == "memory" {
+		bag.Store = bag.NewMemoryStore(time.Minute)
+	} else if r, e := bag.ParseRedisURL(*sp, *pool); e != nil {
+		log.Fatalln("invalid session store:", e)
+	} else {
+		r.Timeout = *stt
+		if *sts != "" && *stc {
+			log.Fatalln("Sentinel and Cluster mode of session store are exclusive")
+		} else if *sts != "" {
+			r.Sentinels = strings.Split(*sts, ",")
+			r.MasterName, _, _ = net.SplitHostPort(r.Addr)
+		} else if *stc && r.DB != 0 {
+			log.Fatalln("Redis Cluster supports only DB 0")
+		}
+		r.Cluster = *stc
+		bag.Store = r
+	}
+	if *kek != "" {
+		bag.SessionKeys = map[string][]byte{}
+		for i, kv := range strings.Split(*kek, ",") {
+			id, kh, ok := strings.Cut(kv, "=")
+			k, e := hex.DecodeString(strings.TrimSpace(kh))
+			if id = strings.TrimSpace(id); !ok || id == "" || strings.Contains(id, ":") {
+				log.Fatalln("invalid session key ID:", kv)
+			} else if e != nil || (len(k) != 16 && len(k) != 24 && len(k) != 32) {
+				log.Fatalln("invalid session key of", id, ", 16, 24 or 32 octets hex is required")
+			}
+			bag.SessionKeys[id] = k
+			if i == 0 {
+				bag.SessionKeyID = id
+			}
+		}
+	}
+	if *bd != "" {
+		bag.BSFDomains = strings.Split(*bd, ",")
+	}
+
+	if *lr != "" {
+		for _, r := range strings.Split(*lr, ",") {
+			kv := strings.SplitN(r, "=", 2)
+			if len(kv) != 2 {
+				log.Fatalln("invalid realm lifetime:", r)
+			}
+			d, e := time.ParseDuration(kv[1])
+			if e != nil {
+				log.Fatalln("invalid realm lifetime:", r)
+			}
+			bag.Lifetime.Realm[strings.TrimSpace(kv[0])] = d
+		}
+	}
+
+	bag.Log = func(a ...any) {
+		if len(a) != 0 {
+			log.Println(a...)
+		}
+	}
+
+	if *ree {
+		if bag.SessionKeys == nil {
+			log.Fatalln("-store-kek is required for re-encryption")
+		}
+		n, e := bag.ReEncryptSessions(bag.Store)
+		log.Println(n, "sessions are re-encrypted with key", bag.SessionKeyID)
+		if e != nil {
+			log.Fatalln("re-encryption failed:", e)
+		}
+		return
+	}
+
+	if *up != "" {
+		u, e := url.Parse(*up)
+		if e != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			log.Fatalln("invalid upstream URL:", *up)
+		}
+		bag.Upstream = u
+	}
+	if *rf != "" {
+		if e := bag.LoadRoutes(*rf); e != nil {
+			log.Fatalln("failed to load NAF route table:", e)
+		}
+		log.Println("NAF route table is loaded with", len(bag.Routes), "routes")
+	}
+
+	if m, e := bag.ParseAssertionMode(*as); e != nil {
+		log.Fatalln(e)
+	} else {
+		bag.IdentityAssertion = m
+	}
+
 	connector.TermSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, os.Interrupt}
 
+	switch *zn {
+	case "local":
+		diameter.Handle(310, 16777220, 10415, bag.BootstrappingInfoHandler, connector.DefaultRouter)
+	case "diameter":
+		bag.ZnRequest = bag.BootstrappingInfoRequest
+	default:
+		if u, e := url.Parse(*zn); e != nil || u.Host == "" || u.Scheme != "https" {
+			log.Fatalln("invalid Zn reference point, diameter or HTTPS URL is required:", *zn)
+		}
+		c, e := tls.LoadX509KeyPair(*cr, *ky)
+		if e != nil {
+			log.Fatalln("failed to load NAF client certificate for Zn API:", e)
+		}
+		conf := &tls.Config{Certificates: []tls.Certificate{c}}
+		if *zc != "" {
+			if conf.RootCAs, e = certPool(*zc); e != nil {
+				log.Fatalln("failed to load CA certificate of Zn API:", e)
+			}
+		}
+		bag.ZnClient.Transport = &http.Transport{TLSClientConfig: conf}
+		bag.ZnURL = *zn
+		bag.ZnRequest = bag.HTTPBootstrappingInfoRequest
+	}
+
+	if bag.NAFKeyCache {
+		bag.ListenRevocation()
+	}
+
 	diameter.ConnectionUpNotify = func(c *diameter.Connection) {
 		buf := new(strings.Builder)
 		fmt.Fprintln(buf, "DIAMETER connection up")
@@ -40,22 +216,65 @@ func main() {
 		ch <- errors.Join(errors.New("DIAMETER is closed"), connector.DialAndServe(*dl, *dp))
 	}()
 
-	go func() {
-		ch <- errors.Join(errors.New("BSF HTTP is closed"),
-			http.ListenAndServe(*bl+":80", http.HandlerFunc(bag.BootstrapHandler)))
-	}()
-	go func() {
-		svr := &http.Server{
-			Addr:      *bl + ":443",
-			Handler:   http.HandlerFunc(bag.BootstrapHandler),
-			TLSConfig: &tls.Config{CipherSuites: []uint16{}},
+	if *zn == "local" {
+		go func() {
+			ch <- errors.Join(errors.New("BSF HTTP is closed"),
+				http.ListenAndServe(*bl+":80", http.HandlerFunc(bag.BootstrapHandler)))
+		}()
+		go func() {
+			svr := &http.Server{
+				Addr:      *bl + ":443",
+				Handler:   http.HandlerFunc(bag.BootstrapHandler),
+				TLSConfig: &tls.Config{CipherSuites: []uint16{}},
+			}
+			for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+				svr.TLSConfig.CipherSuites = append(svr.TLSConfig.CipherSuites, c.ID)
+			}
+			ch <- errors.Join(errors.New("BSF HTTPs is closed"),
+				svr.ListenAndServeTLS(*cr, *ky))
+		}()
+		if *za != "" {
+			if *zc == "" {
+				log.Fatalln("-zn-ca is required to verify NAF client certificate of Zn API")
+			}
+			pool, e := certPool(*zc)
+			if e != nil {
+				log.Fatalln("failed to load CA certificate of Zn API:", e)
+			}
+			go func() {
+				svr := &http.Server{
+					Addr:    *za,
+					Handler: http.HandlerFunc(bag.ZnAPIHandler),
+					TLSConfig: &tls.Config{
+						ClientAuth: tls.RequireAndVerifyClientCert,
+						ClientCAs:  pool},
+				}
+				ch <- errors.Join(errors.New("Zn API HTTPs is closed"),
+					svr.ListenAndServeTLS(*cr, *ky))
+			}()
 		}
-		for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
-			svr.TLSConfig.CipherSuites = append(svr.TLSConfig.CipherSuites, c.ID)
+	}
+
+	if *ra != "" {
+		if *rc == "" {
+			log.Fatalln("-revoke-ca is required to verify client certificate of revocation API")
 		}
-		ch <- errors.Join(errors.New("BSF HTTPs is closed"),
-			svr.ListenAndServeTLS(*cr, *ky))
-	}()
+		pool, e := certPool(*rc)
+		if e != nil {
+			log.Fatalln("failed to load CA certificate of revocation API:", e)
+		}
+		go func() {
+			svr := &http.Server{
+				Addr:    *ra,
+				Handler: http.HandlerFunc(bag.RevocationHandler),
+				TLSConfig: &tls.Config{
+					ClientAuth: tls.RequireAndVerifyClientCert,
+					ClientCAs:  pool},
+			}
+			ch <- errors.Join(errors.New("revocation API HTTPs is closed"),
+				svr.ListenAndServeTLS(*cr, *ky))
+		}()
+	}
 
 	go func() {
 		ch <- errors.Join(errors.New("NAF HTTP is closed"),
@@ -75,3 +294,16 @@ func main() {
 	}()
 	log.Println(<-ch)
 }
+
+// certPool returns certificate pool of the PEM file
+func certPool(file string) (*x509.CertPool, error) {
+	data, e := os.ReadFile(file)
+	if e != nil {
+		return nil, e
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificate in " + file)
+	}
+	return pool, nil
+}
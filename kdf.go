@@ -0,0 +1,79 @@
+package bag
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// FC is function code of the key derivation function defined in TS 33.220 Annex B
+type FC byte
+
+// FCGBA is FC of all key derivations in this package, Ks_NAF, Ks and RES of 2G GBA,
+// Ks of GBA Digest and TMPI. They are distinguished by the label in the parameters.
+const FCGBA FC = 0x01
+
+// KDFParam is input parameter Pi of the key derivation function
+type KDFParam []byte
+
+// KDF returns HMAC-SHA-256(key, S) where S = FC || P0 || L0 || P1 || L1 || ... || Pn || Ln
+// defined in TS 33.220 Annex B.2.
+func KDF(key []byte, fc FC, p ...KDFParam) ([]byte, error) {
+	s, e := kdfInput(fc, p...)
+	if e != nil {
+		return nil, e
+	}
+	return kdfMAC(key, s), nil
+}
+
+// kdfInput returns S = FC || P0 || L0 || P1 || L1 || ... || Pn || Ln
+func kdfInput(fc FC, p ...KDFParam) ([]byte, error) {
+	s := []byte{byte(fc)}
+	for i, pi := range p {
+		if len(pi) > 0xffff {
+			return nil, fmt.Errorf("length of KDF parameter P%d is longer than 65535", i)
+		}
+		s = append(s, pi...)
+		s = append(s, byte(len(pi)>>8), byte(len(pi)))
+	}
+	return s, nil
+}
+
+func kdfMAC(key, s []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(s)
+	return mac.Sum(nil)
+}
+
+// P0 values of NAF specific key derivation
+const (
+	LabelGBAME     = "gba-me"     // Ks_NAF of GBA_ME and Ks_ext_NAF of GBA_U
+	LabelGBAU      = "gba-u"      // Ks_int_NAF of GBA_U
+	LabelGBADigest = "gba-digest" // Ks_NAF of GBA Digest in TS 33.220 Annex M
+)
+
+// Ks returns Ks = CK || IK
+func Ks(ck, ik []byte) []byte {
+	return append(append(make([]byte, 0, len(ck)+len(ik)), ck...), ik...)
+}
+
+// NAFKeyDerivation returns KDF(Ks, label, RAND, IMPI, NAF_ID)
+func NAFKeyDerivation(ks []byte, label string, rand []byte, impi string, nafid []byte) ([]byte, error) {
+	return KDF(ks, FCGBA,
+		KDFParam(label), KDFParam(rand), KDFParam(impi), KDFParam(nafid))
+}
+
+// KsExtNAF returns Ks_NAF of GBA_ME or Ks_ext_NAF of GBA_U
+func KsExtNAF(ks, rand []byte, impi string, nafid []byte) ([]byte, error) {
+	return NAFKeyDerivation(ks, LabelGBAME, rand, impi, nafid)
+}
+
+// KsIntNAF returns Ks_int_NAF of GBA_U
+func KsIntNAF(ks, rand []byte, impi string, nafid []byte) ([]byte, error) {
+	return NAFKeyDerivation(ks, LabelGBAU, rand, impi, nafid)
+}
+
+// KsDigestNAF returns Ks_NAF of GBA Digest
+func KsDigestNAF(ks, rand []byte, impi string, nafid []byte) ([]byte, error) {
+	return NAFKeyDerivation(ks, LabelGBADigest, rand, impi, nafid)
+}
@@ -0,0 +1,139 @@
+package bag
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, e := hex.DecodeString(s)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return b
+}
+
+// HMAC-SHA-256 test cases 1 to 4 of RFC 4231
+func TestKDFMAC(t *testing.T) {
+	for i, v := range []struct{ key, data, mac string }{
+		{strings.Repeat("0b", 20),
+			hex.EncodeToString([]byte("Hi There")),
+			"b0344c61d8db38535ca8afceaf0bf12b881dc200c9833da726e9376c2e32cff7"},
+		{hex.EncodeToString([]byte("Jefe")),
+			hex.EncodeToString([]byte("what do ya want for nothing?")),
+			"5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+		{strings.Repeat("aa", 20),
+			strings.Repeat("dd", 50),
+			"773ea91e36800e46854db8ebd09181a72959098b3ef8c122d9635514ced565fe"},
+		{"0102030405060708090a0b0c0d0e0f10111213141516171819",
+			strings.Repeat("cd", 50),
+			"82558a389a443c0ea4cc819899f2083a85f0faa3e578f8077a2e3ff46729665b"},
+	} {
+		if r := kdfMAC(unhex(t, v.key), unhex(t, v.data)); !bytes.Equal(r, unhex(t, v.mac)) {
+			t.Errorf("test case %d: %x does not match %s", i+1, r, v.mac)
+		}
+	}
+}
+
+// S of Ks_NAF in TS 33.220 Annex B.2 and B.3
+func TestKDFInput(t *testing.T) {
+	rand := unhex(t, "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf")
+	nafid := append([]byte("naf.example.com"), UaHTTPDigest[:]...)
+	s, e := kdfInput(FCGBA, KDFParam(LabelGBAME), KDFParam(rand),
+		KDFParam("user@ims.example.com"), KDFParam(nafid))
+	if e != nil {
+		t.Fatal(e)
+	}
+	expect := "01" +
+		hex.EncodeToString([]byte("gba-me")) + "0006" +
+		"a0a1a2a3a4a5a6a7a8a9aaabacadaeaf" + "0010" +
+		hex.EncodeToString([]byte("user@ims.example.com")) + "0014" +
+		hex.EncodeToString([]byte("naf.example.com")) + "0100000002" + "0014"
+	if r := hex.EncodeToString(s); r != expect {
+		t.Errorf("S %s does not match %s", r, expect)
+	}
+
+	if _, e = kdfInput(FCGBA, make(KDFParam, 0x10000)); e == nil {
+		t.Error("parameter longer than 65535 octets is accepted")
+	}
+}
+
+// Known answers of the derivations are computed with an independent implementation
+// of TS 33.220 Annex B in Python hmac and hashlib, because 3GPP test data in TS 35 series
+// covers AV generation but not these derivations.
+var (
+	kdfCK    = "000102030405060708090a0b0c0d0e0f"
+	kdfIK    = "101112131415161718191a1b1c1d1e1f"
+	kdfRAND  = "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf"
+	kdfIMPI  = "user@ims.example.com"
+	kdfNAFID = NAFID{FQDN: "naf.example.com", UaSPI: UaHTTPDigest}
+)
+
+func TestKsNAF(t *testing.T) {
+	ks := Ks(unhex(t, kdfCK), unhex(t, kdfIK))
+	rand := unhex(t, kdfRAND)
+	for _, v := range []struct {
+		name string
+		f    func(ks, rand []byte, impi string, nafid []byte) ([]byte, error)
+		key  string
+	}{
+		{"Ks_ext_NAF", KsExtNAF, "099acfae70d655c1f3d8a2caf0f90804805765b8cf0c3149e11fce472c24f869"},
+		{"Ks_int_NAF", KsIntNAF, "355de538a57b7c1d3f653121dd2e8fbcc87d5af8207eb0d443ea1958ccd086e6"},
+		{"Ks_NAF of GBA Digest", KsDigestNAF, "35a87c630f73252651ff8e9cffd82871c23dfb77e6fef29d4938d89869998895"},
+	} {
+		r, e := v.f(ks, rand, kdfIMPI, kdfNAFID.Bytes())
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !bytes.Equal(r, unhex(t, v.key)) {
+			t.Errorf("%s %x does not match %s", v.name, r, v.key)
+		}
+	}
+
+	r := KeyDerivation(unhex(t, kdfCK), unhex(t, kdfIK), rand, kdfIMPI, kdfNAFID)
+	if !bytes.Equal(r, unhex(t, "099acfae70d655c1f3d8a2caf0f90804805765b8cf0c3149e11fce472c24f869")) {
+		t.Errorf("Ks_NAF of GBA_ME %x does not match", r)
+	}
+}
+
+func TestTripletAV(t *testing.T) {
+	tr := Triplet{
+		RAND: unhex(t, kdfRAND),
+		SRES: unhex(t, "c0c1c2c3"),
+		Kc:   unhex(t, "0123456789abcdef")}
+	av, e := tr.AV(unhex(t, "404142434445464748494a4b4c4d4e4f"), kdfIMPI)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if ks := "49ad52b31ad612c4aac7ffa9ecf6736886de11982608f0d706bc0563fdd5060d"; !bytes.Equal(Ks(av.CK, av.IK), unhex(t, ks)) {
+		t.Errorf("Ks %x%x does not match %s", av.CK, av.IK, ks)
+	}
+	if res := "2de9f2e74cd330b56ba9bb9b4291aeb2"; !bytes.Equal(av.RES, unhex(t, res)) {
+		t.Errorf("RES %x does not match %s", av.RES, res)
+	}
+}
+
+func TestSIPDigestAV(t *testing.T) {
+	d := SIPDigest{
+		Realm: "ims.example.com",
+		HA1:   DigestHA1(kdfIMPI, "ims.example.com", "secret")}
+	if ha1 := "337c1d9c3cccf0bf86c112f1e7fe1d03"; !bytes.Equal(d.HA1, unhex(t, ha1)) {
+		t.Fatalf("H(A1) %x does not match %s", d.HA1, ha1)
+	}
+	av, e := d.AV(unhex(t, kdfRAND), make([]byte, 16), kdfIMPI)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if ks := "abb0af9b1f1e16e3e84b354424d41ebf715d5af44fdbc4b77dd7688b50a45373"; !bytes.Equal(Ks(av.CK, av.IK), unhex(t, ks)) {
+		t.Errorf("Ks %x%x does not match %s", av.CK, av.IK, ks)
+	}
+}
+
+func TestTMPI(t *testing.T) {
+	ks := Ks(unhex(t, kdfCK), unhex(t, kdfIK))
+	if r, tmpi := TMPI(ks, "bsf.example.com"), "8zgQXKGSvkOZSWG/hLblng==@tmpi.bsf.example.com"; r != tmpi {
+		t.Errorf("TMPI %s does not match %s", r, tmpi)
+	}
+}
@@ -0,0 +1,45 @@
+package bag
+
+import (
+	"strings"
+	"time"
+)
+
+// LifetimePolicy is lifetime policy of bootstrapping session and Ks_NAF
+type LifetimePolicy struct {
+	Default time.Duration            // default lifetime of Ks
+	Realm   map[string]time.Duration // lifetime of Ks for realm of the IMPI
+	GUSS    bool                     // use key lifetime in GUSS if present
+	KsNAF   time.Duration            // lifetime of Ks_NAF from boot time, zero for same as Ks
+	Nonce   time.Duration            // lifetime of nonce in Digest challenge
+}
+
+// Lifetime is lifetime policy of BSF and NAF
+var Lifetime = LifetimePolicy{
+	Default: time.Second * 10,
+	Realm:   map[string]time.Duration{},
+	Nonce:   time.Minute}
+
+// Bootstrap returns lifetime of Ks for the IMPI
+func (p LifetimePolicy) Bootstrap(impi string, guss *GUSS) time.Duration {
+	if p.GUSS && guss != nil && guss.KeyLifetime > 0 {
+		return guss.KeyLifetime
+	}
+	if i := strings.LastIndex(impi, "@"); i >= 0 {
+		if d, ok := p.Realm[impi[i+1:]]; ok {
+			return d
+		}
+	}
+	return p.Default
+}
+
+// NAFKeyExpire returns expiry time of Ks_NAF that never outlives the Ks
+func (p LifetimePolicy) NAFKeyExpire(ks, boot time.Time) time.Time {
+	if p.KsNAF <= 0 || boot.IsZero() {
+		return ks
+	}
+	if t := boot.Add(p.KsNAF); t.Before(ks) {
+		return t
+	}
+	return ks
+}
@@ -18,10 +18,13 @@ import (
 )
 
 type clientInfo struct {
-	auth   bag.WWWAuthenticate
-	btid   string
-	client *http.Client
-	cipher uint32
+	auth      bag.WWWAuthenticate
+	btid      string
+	nextnonce string // nextnonce from BSF for next bootstrap
+	client    *http.Client
+	uaspi     bag.UaSecurityProtocolID
+	gbaType   bag.GBAType
+	bsfAV     bag.AV // AV derived in bootstrap of 2G GBA and GBA Digest
 }
 
 var clientMap = make(chan (map[string]clientInfo), 1)
@@ -68,10 +71,31 @@ func gbaClientHandler(r common.MeReq) common.MeAns {
 		fmt.Println("\n", "[INFO]", "starting new GBA request:", r.Method, r.RequestURI)
 	}
 
-	av := common.QueryDB(r.IMPI)
+	sub := common.QueryDB(r.IMPI)
+	av := sub.AV
 	av.IMPI = r.IMPI
 
-	if *verbose {
+	var sim *bag.Triplet
+	var dig *bag.SIPDigest
+	if len(sub.Digest.HA1) != 0 && (*gbaDigest || (len(av.RAND) == 0 && len(sub.SIM.RAND) == 0)) {
+		dig = &sub.Digest
+		if *verbose {
+			fmt.Println("\n", "[INFO]", "retrieved SIP Digest credential info")
+			fmt.Printf("  | realm    = %s\n", dig.Realm)
+			fmt.Printf("  | H(A1)    = %x\n", dig.HA1)
+			fmt.Printf("  | IMPI     = %s\n", av.IMPI)
+		}
+	} else if len(av.RAND) == 0 && len(sub.SIM.RAND) != 0 {
+		// SIM-only subscriber uses 2G GBA
+		sim = &sub.SIM
+		if *verbose {
+			fmt.Println("\n", "[INFO]", "retrieved SIM triplet info")
+			fmt.Printf("  | RAND     = %x\n", sim.RAND)
+			fmt.Printf("  | SRES     = %x\n", sim.SRES)
+			fmt.Printf("  | Kc       = %x\n", sim.Kc)
+			fmt.Printf("  | IMPI     = %s\n", av.IMPI)
+		}
+	} else if *verbose {
 		fmt.Println("\n", "[INFO]", "retrieved AV info")
 		fmt.Printf("  | RAND     = %x\n", av.RAND)
 		fmt.Printf("  | AUTN     = %x\n", av.AUTN)
@@ -129,7 +153,7 @@ func gbaClientHandler(r common.MeReq) common.MeAns {
 	clientMap <- cm
 	if !ok {
 		info.client = &http.Client{Timeout: expire, Transport: transport.Clone()}
-		info.cipher = 2
+		info.uaspi = bag.UaHTTPDigest
 	}
 
 	var nc uint64 = 0
@@ -157,23 +181,39 @@ func gbaClientHandler(r common.MeReq) common.MeAns {
 				}
 			}
 
-			ksnaf := base64.StdEncoding.EncodeToString(bag.KeyDerivation(
-				av.CK, av.IK, av.RAND, av.IMPI, req.Host, 1, info.cipher))
+			nafid := bag.NAFID{FQDN: req.URL.Hostname(), UaSPI: info.uaspi}
+			if info.gbaType == bag.GBA2G || info.gbaType == bag.GBADigest {
+				av = info.bsfAV
+			}
+			name := "Ks_naf"
+			var ks []byte
+			if info.gbaType == bag.GBADigest {
+				ks, _ = bag.KsDigestNAF(bag.Ks(av.CK, av.IK), av.RAND, av.IMPI, nafid.Bytes())
+			} else if info.gbaType == bag.GBAU && r.UICCKey {
+				// Ks_int_NAF is derived in UICC and used by UICC application
+				name = "Ks_int_naf"
+				ks, _ = bag.KsIntNAF(bag.Ks(av.CK, av.IK), av.RAND, av.IMPI, nafid.Bytes())
+			} else {
+				if info.gbaType == bag.GBAU {
+					name = "Ks_ext_naf"
+				}
+				ks = bag.KeyDerivation(av.CK, av.IK, av.RAND, av.IMPI, nafid)
+			}
+			ksnaf := base64.StdEncoding.EncodeToString(ks)
 			if *verbose {
-				fmt.Println("\n", "[INFO]", "Ks_naf", ksnaf, "is generated from")
+				fmt.Println("\n", "[INFO]", name, ksnaf, "is generated from")
 				fmt.Printf("  | CK       = %x\n", av.CK)
 				fmt.Printf("  | IK       = %x\n", av.IK)
 				fmt.Printf("  | RAND     = %x\n", av.RAND)
 				fmt.Printf("  | IMPI     = %s\n", av.IMPI)
-				fmt.Printf("  | NAF host = %s\n", req.Host)
-				fmt.Printf("  | vendor   = 1\n")
-				fmt.Printf("  | protocol = %x\n", info.cipher)
+				fmt.Printf("  | NAF host = %s\n", nafid.FQDN)
+				fmt.Printf("  | Ua SPI   = %x (%s)\n", nafid.UaSPI[:], nafid.UaSPI)
 			}
 
 			auth.SetResponse(req.Method, []byte(ksnaf), r.Body)
 			req.Header.Set("Authorization", auth.String())
 		}
-		req.Header.Set("User-Agent", uaPrefix+"3gpp-gba")
+		req.Header.Set("User-Agent", userAgent(dig != nil))
 		if r.IMPU != "" {
 			req.Header.Set("X-3GPP-Intended-Identity", r.IMPU)
 		}
@@ -205,8 +245,8 @@ func gbaClientHandler(r common.MeReq) common.MeAns {
 				fmt.Println("", "[INFO]", "connection is TLS with cipher",
 					tls.CipherSuiteName(res.TLS.CipherSuite))
 			}
-			info.cipher = 0x0100 | uint32(res.TLS.CipherSuite)
 		}
+		info.uaspi = bag.UaFromConnection(res.TLS)
 		if *verbose {
 			fmt.Println("  <", res.Proto, res.Status)
 			logHeader(res.Header, "  <")
@@ -245,15 +285,37 @@ func gbaClientHandler(r common.MeReq) common.MeAns {
 			return errorResult(http.StatusBadGateway,
 				fmt.Errorf("invalid WWW-Authenticate header from NAF: %s", e))
 		}
+		nc = 0
+		if info.auth.Stale && info.btid != "" {
+			// B-TID is still valid, retry with new nonce
+			cm := <-clientMap
+			cm[infoKey] = info
+			clientMap <- cm
+			if *verbose {
+				fmt.Println("\n", "[INFO]", "NAF nonce is stale, retrying NAF access with B-TID", info.btid)
+			}
+			continue
+		}
 		if *verbose {
 			fmt.Println("\n", "[INFO]", "BSF authentication is required")
 		}
 
-		info.btid, e = bootstrap(av, info.client)
+		nextnonce := info.nextnonce
+		if r.NextNonce != "" {
+			nextnonce = r.NextNonce
+			if *verbose {
+				fmt.Println(" [INFO] override BSF nextnonce to", nextnonce)
+			}
+		}
+		bav := av
+		info.btid, info.nextnonce, info.gbaType, e = bootstrap(&bav, sim, dig, info.client, nextnonce)
 		if e != nil {
 			return errorResult(http.StatusForbidden,
 				fmt.Errorf("bootstrap to BFS failed: %s", e))
 		}
+		if info.gbaType == bag.GBA2G || info.gbaType == bag.GBADigest {
+			info.bsfAV = bav
+		}
 		cm := <-clientMap
 		cm[infoKey] = info
 		clientMap <- cm
@@ -4,21 +4,53 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/base64"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/fkgi/bag"
 )
 
-func bootstrap(av bag.AV, client *http.Client) (string, error) {
-	bsfAuth := bag.WWWAuthenticate{}
+// tmpiMap is TMPI of the IMPI derived in the last bootstrap
+var tmpiMap = make(chan (map[string]string), 1)
+
+func init() {
+	tmpiMap <- map[string]string{}
+}
+
+func getTMPI(impi string) string {
+	m := <-tmpiMap
+	defer func() { tmpiMap <- m }()
+	return m[impi]
+}
+
+func setTMPI(impi, tmpi string) {
+	m := <-tmpiMap
+	if tmpi == "" {
+		delete(m, impi)
+	} else {
+		m[impi] = tmpi
+	}
+	tmpiMap <- m
+}
+
+func bootstrap(av *bag.AV, sim *bag.Triplet, dig *bag.SIPDigest, client *http.Client, nextnonce string) (string, string, bag.GBAType, error) {
+	bsfAuth := bag.WWWAuthenticate{Nonce: nextnonce}
+	gbaType := bag.GBAME
+	tmpi := ""
+	if *useTMPI {
+		tmpi = getTMPI(av.IMPI)
+	}
 
 	for i := 0; i < authRetransmit; i++ {
+		reuse := nextnonce != "" && bsfAuth.Nonce == nextnonce
 		req, _ := http.NewRequest(http.MethodGet, bsf, nil)
+		if (sim != nil || dig != nil) && req.URL.Scheme != "https" {
+			return "", "", gbaType, errors.New("2G GBA and GBA Digest require TLS to BSF")
+		}
 		auth := bag.Authorization{
 			Username: av.IMPI,
 			Realm:    req.Host,
@@ -26,6 +58,9 @@ func bootstrap(av bag.AV, client *http.Client) (string, error) {
 		if auth.Uri == "" {
 			auth.Uri = "/"
 		}
+		if tmpi != "" {
+			auth.Username = tmpi
+		}
 		if bsfAuth.Nonce != "" {
 			auth.Nonce = bsfAuth.Nonce
 			auth.Cnonce = bag.NewRandText()
@@ -38,8 +73,33 @@ func bootstrap(av bag.AV, client *http.Client) (string, error) {
 				}
 			}
 
-			d, _ := base64.StdEncoding.DecodeString(bsfAuth.Nonce)
-			if bytes.Equal(d[16:], av.AUTN) {
+			rand, autn, _, _ := bsfAuth.BootstrapNonce()
+			if dig != nil {
+				// Digest realm of the credential and server data instead of AUTN
+				auth.Realm = dig.Realm
+				var e error
+				if *av, e = dig.AV(rand, autn, av.IMPI); e != nil {
+					return "", "", gbaType, fmt.Errorf("GBA Digest key derivation failed: %s", e)
+				}
+				gbaType = bag.GBADigest
+				auth.SetDigestResponse(req.Method, av.RES, []byte{})
+			} else if sim != nil {
+				// SIM runs GSM algorithm with RAND and ME derives Ks and RES with Ks-input
+				if !bytes.Equal(rand, sim.RAND) {
+					return "", "", gbaType, fmt.Errorf("RAND %x in BSF challenge is not known by SIM", rand)
+				}
+				var e error
+				if *av, e = sim.AV(autn, av.IMPI); e != nil {
+					return "", "", gbaType, fmt.Errorf("2G GBA key derivation failed: %s", e)
+				}
+				gbaType = bag.GBA2G
+				auth.SetResponse(req.Method, av.RES, []byte{})
+			} else if *gbaU && bag.GBAUCapable(av.AUTN) && bytes.Equal(autn, bag.GBAUAUTN(av.AUTN, av.IK)) {
+				// UICC gets AUTN from AUTN*, checks AMF separation bit and derives Ks in UICC
+				gbaType = bag.GBAU
+				auth.SetResponse(req.Method, av.RES, []byte{})
+			} else if bytes.Equal(autn, av.AUTN) {
+				gbaType = bag.GBAME
 				auth.SetResponse(req.Method, av.RES, []byte{})
 			} else {
 				// registerAV()
@@ -49,11 +109,15 @@ func bootstrap(av bag.AV, client *http.Client) (string, error) {
 			}
 		}
 		req.Header.Set("Authorization", auth.String())
-		req.Header.Set("User-Agent", uaPrefix+"3gpp-gba")
+		req.Header.Set("User-Agent", userAgent(dig != nil))
 		req.Header.Set("Accept", "*/*")
 
 		if *verbose {
-			fmt.Println("\n", "[INFO]", "bootstrapping to", req.Host)
+			if reuse {
+				fmt.Println("\n", "[INFO]", "bootstrapping with nextnonce to", req.Host)
+			} else {
+				fmt.Println("\n", "[INFO]", "bootstrapping to", req.Host)
+			}
 			fmt.Println("  >", req.Method, req.URL, req.Proto)
 			fmt.Println("  >", "Host :", req.Host)
 			logHeader(req.Header, "  >")
@@ -61,7 +125,7 @@ func bootstrap(av bag.AV, client *http.Client) (string, error) {
 
 		res, e := client.Do(req)
 		if e != nil {
-			return "", fmt.Errorf("failed to access BSF: %s", e)
+			return "", "", gbaType, fmt.Errorf("failed to access BSF: %s", e)
 		}
 		if *verbose {
 			fmt.Println("\n", "[INFO]", "response from BSF", req.Host)
@@ -76,60 +140,112 @@ func bootstrap(av bag.AV, client *http.Client) (string, error) {
 			logHeader(res.Header, "  <")
 		}
 
+		if tmpi != "" && res.StatusCode == http.StatusNotFound {
+			// TMPI is unknown in BSF, retry with IMPI
+			if *verbose {
+				fmt.Println("\n", "[INFO]", "TMPI", tmpi, "is unknown by BSF, retrying with IMPI")
+			}
+			res.Body.Close()
+			setTMPI(av.IMPI, "")
+			tmpi = ""
+			bsfAuth = bag.WWWAuthenticate{}
+			nextnonce = ""
+			continue
+		}
+
 		switch res.StatusCode {
 		case http.StatusUnauthorized:
+			if reuse && *verbose {
+				fmt.Println("\n", "[INFO]", "nextnonce is rejected by BSF with new challenge")
+			}
 			bsfAuth, e = bag.ParseaWWWAuthenticate(res.Header.Get("WWW-Authenticate"))
 			if e != nil || bsfAuth.Realm == "" || bsfAuth.Nonce == "" {
-				return "", fmt.Errorf("no valid WWW-Authenticate header in BSF challenge: %s", e)
+				return "", "", gbaType, fmt.Errorf("no valid WWW-Authenticate header in BSF challenge: %s", e)
 			}
-			d, e := base64.StdEncoding.DecodeString(bsfAuth.Nonce)
+			rand, autn, sd, e := bsfAuth.BootstrapNonce()
 			if e != nil {
-				return "", fmt.Errorf("invalid nonce in WWW-Authenticate in BSF challenge: %s", e)
-			}
-			if len(d) != 32 {
-				return "", errors.New("invalid nonce in WWW-Authenticate in BSF challenge: " +
-					"data size is not 16+16 octets")
+				return "", "", gbaType, fmt.Errorf("invalid nonce in WWW-Authenticate in BSF challenge: %s", e)
 			}
 
 			if *verbose {
-				fmt.Println("\n", "[INFO]", "AKA authentication is required")
-				fmt.Printf("  | RAND = %x\n", d[:16])
-				fmt.Printf("  | AUTN = %x\n", d[16:])
-			}
-		case http.StatusOK:
-			/*
-				authInfo, e := bag.ParseaAuthenticationInfo(
-					res.Header.Get("Authentication-Info"))
-				if e == nil {
-					bsfAuth.Nonce = authInfo.Nextnonce
+				if dig != nil {
+					fmt.Println("\n", "[INFO]", "GBA Digest authentication is required")
+					fmt.Printf("  | realm    = %s\n", bsfAuth.Realm)
+					fmt.Printf("  | RAND     = %x\n", rand)
+				} else if sim != nil {
+					fmt.Println("\n", "[INFO]", "2G GBA authentication is required")
+					fmt.Printf("  | RAND     = %x\n", rand)
+					fmt.Printf("  | Ks-input = %x\n", autn)
 				} else {
-					fmt.Println("BSF returns invalid Authentication-Info header:", e)
+					fmt.Println("\n", "[INFO]", "AKA authentication is required")
+					fmt.Printf("  | RAND = %x\n", rand)
+					fmt.Printf("  | AUTN = %x\n", autn)
 				}
-			*/
-
+				if len(sd) != 0 {
+					fmt.Printf("  | server data = %d octets\n", len(sd))
+				}
+			}
+		case http.StatusOK:
 			data, _ := io.ReadAll(res.Body)
 			defer res.Body.Close()
 			if len(data) != 0 && *verbose {
 				fmt.Println("  <")
 				fmt.Println("  <", string(data))
 			}
-			info := struct {
-				Xmlns   string `xml:"xmlns,attr"`
-				BTID    string `xml:"btid"`
-				Liftime string `xml:"lifetime"`
-			}{}
-			e = xml.Unmarshal(data, &info)
-
-			return info.BTID, e
+
+			nextnonce = ""
+			authInfo, e := bag.ParseaAuthenticationInfo(
+				res.Header.Get("Authentication-Info"))
+			if e != nil {
+				fmt.Fprintln(os.Stderr, "\n", "[ERR]",
+					"BSF returns invalid Authentication-Info header:", e)
+			} else if setResponse(&auth, gbaType, av.RES, data); auth.Response != authInfo.Rspauth {
+				fmt.Fprintln(os.Stderr, "\n", "[ERR]",
+					"BSF returns invalid rspauth in Authentication-Info header")
+			} else {
+				nextnonce = authInfo.Nextnonce
+			}
+			info, e := bag.ParseBootstrappingInfo(data)
+			if e != nil {
+				return "", "", gbaType, fmt.Errorf("invalid BootstrappingInfo from BSF: %s", e)
+			}
+			tmpi = ""
+			if *useTMPI && bag.HasProductToken(res.Header.Get("Server"), bag.TMPIProductToken) {
+				tmpi = bag.TMPI(bag.Ks(av.CK, av.IK), req.URL.Hostname())
+			}
+			setTMPI(av.IMPI, tmpi)
+			if *verbose {
+				rand, domain, _ := bag.ParseBTID(info.BTID)
+				fmt.Println("\n", "[INFO]", "B-TID", info.BTID, "is assigned")
+				fmt.Printf("  | RAND     = %x\n", rand)
+				fmt.Printf("  | domain   = %s\n", domain)
+				fmt.Printf("  | lifetime = %s\n", info.Lifetime)
+				fmt.Printf("  | GBA type = %s\n", gbaType)
+				if nextnonce != "" {
+					fmt.Printf("  | nextnonce= %s\n", nextnonce)
+				}
+				if tmpi != "" {
+					fmt.Printf("  | TMPI     = %s\n", tmpi)
+				}
+			}
+			return info.BTID, nextnonce, gbaType, nil
 		default:
-			return "", errors.New("unexpected BSF response " + res.Status)
+			return "", "", gbaType, errors.New("unexpected BSF response " + res.Status)
 		}
 		if *verbose {
 			fmt.Println("\n", "[INFO]", "retrying BSF access")
 		}
 	}
 
-	return "", errors.New("bootstraping authentication retry count exceeded")
+	return "", "", gbaType, errors.New("bootstraping authentication retry count exceeded")
+}
+
+func setResponse(auth *bag.Authorization, t bag.GBAType, res, body []byte) {
+	if t == bag.GBADigest {
+		auth.SetDigestResponse("", res, body)
+	} else {
+		auth.SetResponse("", res, body)
+	}
 }
 
 func logHeader(h http.Header, prefix string) {
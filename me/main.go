@@ -13,6 +13,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/fkgi/bag"
 	"github.com/fkgi/bag/common"
 )
 
@@ -23,6 +24,9 @@ var (
 	transport      *http.Transport
 	expire         time.Duration
 	verbose        *bool
+	gbaU           *bool
+	gbaDigest      *bool
+	useTMPI        *bool
 )
 
 const uaPrefix = ""
@@ -48,8 +52,14 @@ func main() {
 	flag.StringVar(&ciphers, "ciphers", ciphers, "comma separated names of ciphers for TLS")
 
 	verbose = flag.Bool("verbose", false, "verbose log mode")
+	gbaU = flag.Bool("gba-u", false, "GBA_U mode with UICC-side key derivation")
+	gbaDigest = flag.Bool("gba-digest", false, "GBA Digest mode for subscriber with SIP Digest credential")
+	useTMPI = flag.Bool("tmpi", false, "use TMPI instead of IMPI for next bootstrap")
 
 	flag.Parse()
+	if *gbaU {
+		fmt.Println("", "[INFO]", "GBA_U mode is enabled")
+	}
 
 	if u, e := url.Parse(bsf); e != nil || u.Host == "" || u.Scheme == "" {
 		fmt.Fprintln(os.Stderr, "", "[ERR]", "invalid BSF URL:", bsf)
@@ -121,3 +131,17 @@ func main() {
 		go gbaClientSession(c)
 	}
 }
+
+func userAgent(digest bool) string {
+	ua := uaPrefix + "3gpp-gba"
+	if *gbaU {
+		ua += " " + bag.UICCProductToken
+	}
+	if digest {
+		ua += " " + bag.DigestProductToken
+	}
+	if *useTMPI {
+		ua += " " + bag.TMPIProductToken
+	}
+	return ua
+}
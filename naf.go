@@ -1,81 +1,344 @@
 package bag
 
 import (
+	"bytes"
 	"encoding/base64"
-	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
+// AssertionMode is X-3GPP-Asserted-Identity generation mode of NAF
+type AssertionMode int
+
+const (
+	AssertNone           AssertionMode = iota // no X-3GPP-Asserted-Identity
+	AssertIntended                            // copy X-3GPP-Intended-Identity without GUSS
+	AssertIntendedByGUSS                      // copy X-3GPP-Intended-Identity verified by GUSS
+	AssertGUSS                                // IMPUs in GUSS
+)
+
+var assertionModeNames = map[AssertionMode]string{
+	AssertNone:           "none",
+	AssertIntended:       "intended",
+	AssertIntendedByGUSS: "intended-guss",
+	AssertGUSS:           "guss",
+}
+
+func (m AssertionMode) String() string {
+	if s, ok := assertionModeNames[m]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// ParseAssertionMode returns AssertionMode from the name
+func ParseAssertionMode(s string) (AssertionMode, error) {
+	for m, n := range assertionModeNames {
+		if n == s {
+			return m, nil
+		}
+	}
+	return AssertNone, fmt.Errorf("unknown identity assertion mode %s", s)
+}
+
+// IdentityAssertion is X-3GPP-Asserted-Identity generation mode of NAF
+var IdentityAssertion = AssertNone
+
+func assertIdentity(intended []string, guss *GUSS) ([]string, error) {
+	switch IdentityAssertion {
+	case AssertIntended:
+		return intended, nil
+	case AssertIntendedByGUSS, AssertGUSS:
+		if IdentityAssertion == AssertIntendedByGUSS && len(intended) == 0 {
+			return nil, nil
+		}
+		if guss == nil {
+			return nil, errors.New("no GUSS for identity verification")
+		}
+		impus := guss.IMPUs()
+	loop:
+		for _, id := range intended {
+			for _, impu := range impus {
+				if id == impu {
+					continue loop
+				}
+			}
+			return nil, fmt.Errorf("identity %s is not owned by the subscriber", id)
+		}
+		if IdentityAssertion == AssertGUSS {
+			return impus, nil
+		}
+		return intended, nil
+	}
+	return nil, nil
+}
+
+func parseIdentityList(s string) []string {
+	ret := []string{}
+	for _, id := range strings.Split(s, ",") {
+		id = strings.Trim(strings.TrimSpace(id), `"`)
+		if id != "" {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+func formatIdentityList(ids []string) string {
+	buf := new(strings.Builder)
+	for i, id := range ids {
+		if i != 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(buf, `"%s"`, id)
+	}
+	return buf.String()
+}
+
 func ApplicationHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Server", productName+" NAF")
 
+	rt, e := matchRoute(r)
+	if e != nil {
+		Log("[INFO]", "NAF request rejected:", e)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if rt.RequireTLS && r.TLS == nil {
+		Log("[INFO]", "NAF request rejected:", "TLS is required for", r.Host+r.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
 	auth, e := ParseaAuthorization(r.Header.Get("Authorization"))
 	if e != nil || auth.Realm == "" {
-		w.Header().Set("WWW-Authenticate", WWWAuthenticate{
-			Algorithm: "MD5",
-			Realm:     "3GPP-bootstrapping@" + r.Host,
-			Nonce:     NewRandText(),
-			Qop:       qop,
-			Opaque:    NewRandText()}.String())
-		w.WriteHeader(http.StatusUnauthorized)
+		nafChallenge(w, r, rt, false)
 		return
 	}
 
-	av, ttl, e := getCachedAV(auth.Username)
-	if ttl.IsZero() {
-		w.Header().Set("WWW-Authenticate", WWWAuthenticate{
-			Algorithm: "MD5",
-			Realm:     "3GPP-bootstrapping@" + r.Host,
-			Nonce:     NewRandText(),
-			Qop:       qop,
-			Opaque:    NewRandText()}.String())
-		w.WriteHeader(http.StatusUnauthorized)
+	if auth.Realm != "3GPP-bootstrapping@"+r.Host {
+		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	if auth.Realm != "3GPP-bootstrapping@"+r.Host {
+	stale := false
+	if e = verifyChallenge(auth); e == errStaleNonce {
+		stale = true
+	} else if e != nil {
+		Log("[INFO]", "NAF request rejected:", e)
+		nafChallenge(w, r, rt, false)
+		return
+	}
+
+	if _, d, e := ParseBTID(auth.Username); e != nil || !validBSFDomain(d) {
+		Log("[INFO]", "NAF request with invalid B-TID", auth.Username)
+		nafChallenge(w, r, rt, false)
+		return
+	}
+
+	nafid := NAFIDFromRequest(r.Host, r.TLS)
+	var key NAFKey
+	cached := false
+	if NAFKeyCache {
+		key, cached = cachedNAFKey(auth.Username, nafid, rt.UICCKey)
+	}
+	if cached {
+		e = nil
+	} else if key, e = ZnRequest(auth.Username, nafid, rt.UICCKey); e == nil && NAFKeyCache {
+		cacheNAFKey(auth.Username, nafid, rt.UICCKey, key)
+	}
+	if e == ErrUnknownBTID ||
+		(e == nil && Lifetime.NAFKeyExpire(key.Expire, key.BootTime).Before(time.Now())) {
+		nafChallenge(w, r, rt, false)
+		return
+	} else if e != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	intended := parseIdentityList(r.Header.Get("X-3GPP-Intended-Identity"))
+	allowed, e := rt.authorize(auth, key, intended)
+	if e != nil {
+		Log("[INFO]", "NAF request from", key.IMPI, "rejected by policy:", e)
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
+	ks := key.Ks
+	if rt.UICCKey {
+		if len(key.KsInt) == 0 {
+			Log("[INFO]", "NAF request from", key.IMPI, "rejected: no Ks_int_NAF for", key.Type, "session")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		ks = key.KsInt
+	}
+
 	cres := auth.Response
 	body, _ := io.ReadAll(r.Body)
 	defer r.Body.Close()
 
-	cipher := uint32(2)
-	if r.TLS != nil {
-		cipher = 0x0100 | uint32(r.TLS.CipherSuite)
-	}
-	/*
-		fmt.Printf("  CK       = %x\n", av.CK)
-		fmt.Printf("  IK       = %x\n", av.IK)
-		fmt.Printf("  RAND     = %x\n", av.RAND)
-		fmt.Printf("  IMPI     = %s\n", av.IMPI)
-		fmt.Printf("  NAF host = %s\n", r.Host)
-		fmt.Printf("  vendor   = 1\n")
-		fmt.Printf("  protocol = %x\n", cipher)
-	*/
-	ksnaf := base64.StdEncoding.EncodeToString(KeyDerivation(
-		av.CK, av.IK, av.RAND, av.IMPI, r.Host, 1, cipher))
+	ksnaf := base64.StdEncoding.EncodeToString(ks)
 	auth.SetResponse(r.Method, []byte(ksnaf), body)
 	if auth.Response != cres {
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
+	if stale {
+		nafChallenge(w, r, rt, true)
+		return
+	}
+	if ok, e := acceptNonceCount(auth); e != nil {
+		Log("[ERR]", "failed to check NAF nonce count:", e)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !ok {
+		Log("[INFO]", "NAF request from", key.IMPI, "rejected:", "replayed nc or cnonce", auth.Nc, auth.Cnonce)
+		nafChallenge(w, r, rt, false)
+		return
+	}
 
-	body = []byte("result")
-	ks := []byte{0x00, 0x01}
-	auth.SetResponse("", []byte(hex.EncodeToString(ks)), body)
+	asserted, e := assertIdentity(intended, key.GUSS)
+	if e != nil {
+		Log("[INFO]", "NAF request with", auth.Username, "rejected:", e)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if len(allowed) != 0 && IdentityAssertion != AssertNone {
+		// identities allowed by IMPU pattern of the route are asserted
+		asserted = allowed
+	}
+	r.Header.Del("X-3GPP-Asserted-Identity")
+	if len(asserted) != 0 {
+		r.Header.Set("X-3GPP-Asserted-Identity", formatIdentityList(asserted))
+	}
+
+	if rt.upstream == nil {
+		body = []byte("result")
+		auth.SetResponse("", []byte(ksnaf), body)
+		w.Header().Set("Authentication-Info", AuthenticationInfo{
+			Nextnonce: nafNextNonce(auth, rt),
+			Qop:       auth.Qop,
+			Rspauth:   auth.Response,
+			Cnonce:    auth.Cnonce,
+			Nc:        auth.Nc}.String())
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+		return
+	}
+
+	res, e := forwardRequest(r, rt.upstream, body)
+	if e != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
 
+	for k, v := range CloneHeader(res.Header) {
+		w.Header()[k] = v
+	}
+	body = nil
+	if auth.Qop == "auth-int" {
+		// rspauth of auth-int covers the entity body
+		if body, e = io.ReadAll(res.Body); e != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+	auth.SetResponse("", []byte(ksnaf), body)
 	w.Header().Set("Authentication-Info", AuthenticationInfo{
-		Nextnonce: NewRandText(),
+		Nextnonce: nafNextNonce(auth, rt),
 		Qop:       auth.Qop,
 		Rspauth:   auth.Response,
 		Cnonce:    auth.Cnonce,
 		Nc:        auth.Nc}.String())
-	w.WriteHeader(http.StatusOK)
-	w.Write(body)
+	w.WriteHeader(res.StatusCode)
+	if body != nil {
+		w.Write(body)
+	} else {
+		io.Copy(w, res.Body)
+	}
+}
+
+// BSFDomains is acceptable BSF domain names in B-TID. Any domain is acceptable if empty.
+var BSFDomains []string
+
+func validBSFDomain(d string) bool {
+	if len(BSFDomains) == 0 {
+		return true
+	}
+	for _, bd := range BSFDomains {
+		if strings.EqualFold(bd, d) {
+			return true
+		}
+	}
+	return false
+}
+
+func nafChallenge(w http.ResponseWriter, r *http.Request, rt *Route, stale bool) {
+	c, e := issueChallenge("3GPP-bootstrapping@"+r.Host, NewRandText(), "", rt.qop())
+	if e != nil {
+		Log("[ERR]", "failed to record NAF challenge:", e)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", WWWAuthenticate{
+		Algorithm: "MD5",
+		Realm:     c.Realm,
+		Nonce:     c.Nonce,
+		Qop:       c.Qop,
+		Opaque:    c.Opaque,
+		Stale:     stale}.String())
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func nafNextNonce(auth Authorization, rt *Route) string {
+	c, e := issueChallenge(auth.Realm, NewRandText(), auth.Opaque, rt.qop())
+	if e != nil {
+		Log("[ERR]", "failed to record NAF nextnonce:", e)
+	}
+	return c.Nonce
+}
+
+var (
+	// Upstream is URL of the backend application server of NAF.
+	// NAF answers by itself if nil.
+	Upstream *url.URL
+	// UpstreamTransport is used for forwarding request to Upstream
+	UpstreamTransport http.RoundTripper = http.DefaultTransport
+)
+
+func forwardRequest(r *http.Request, upstream *url.URL, body []byte) (*http.Response, error) {
+	u := *upstream
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawPath = ""
+	u.RawQuery = r.URL.RawQuery
+
+	req, e := http.NewRequestWithContext(r.Context(), r.Method, u.String(), bytes.NewReader(body))
+	if e != nil {
+		return nil, e
+	}
+	req.Header = CloneHeader(r.Header)
+	req.Header.Del("Authorization")
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		req.Header.Set("X-Forwarded-Proto", "http")
+	}
+	if ip, _, e := net.SplitHostPort(r.RemoteAddr); e == nil {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+	}
+	return UpstreamTransport.RoundTrip(req)
 }
 
 var hopHeaders = []string{
@@ -92,6 +355,13 @@ var hopHeaders = []string{
 
 func CloneHeader(h http.Header) http.Header {
 	r := h.Clone()
+	for _, v := range r.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				r.Del(f)
+			}
+		}
+	}
 	for _, h := range hopHeaders {
 		hv := r.Get(h)
 		if hv == "" {
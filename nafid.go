@@ -0,0 +1,138 @@
+package bag
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// UaSecurityProtocolID is Ua security protocol identifier defined in TS 33.220 Annex H.
+// First octet is organization octet and following 4 octets are protocol ID.
+type UaSecurityProtocolID [5]byte
+
+// Organization octet of Ua security protocol identifier
+const (
+	Org3GPP  byte = 0x01
+	Org3GPP2 byte = 0x02
+	OrgOMA   byte = 0x03
+	OrgGSMA  byte = 0x04
+)
+
+// Ua security protocol identifiers of 3GPP
+var (
+	UaSubscriberCertificate = UaSecurityProtocolID{Org3GPP, 0x00, 0x00, 0x00, 0x00} // TS 33.221
+	UaMBMS                  = UaSecurityProtocolID{Org3GPP, 0x00, 0x00, 0x00, 0x01} // TS 33.246
+	UaHTTPDigest            = UaSecurityProtocolID{Org3GPP, 0x00, 0x00, 0x00, 0x02} // TS 24.109
+	UaMBMSHTTP              = UaSecurityProtocolID{Org3GPP, 0x00, 0x00, 0x00, 0x03} // TS 26.237 with HTTP
+	UaMBMSSIP               = UaSecurityProtocolID{Org3GPP, 0x00, 0x00, 0x00, 0x04} // TS 26.237 with SIP
+	UaGenericPush           = UaSecurityProtocolID{Org3GPP, 0x00, 0x00, 0x00, 0x05} // TS 33.224
+	UaIMSMediaKMS           = UaSecurityProtocolID{Org3GPP, 0x00, 0x00, 0x00, 0x06} // TS 33.328
+	UaTMPI                  = UaSecurityProtocolID{Org3GPP, 0x00, 0x00, 0x00, 0x07} // TMPI generation in TS 33.220
+	UaGBADigest             = UaSecurityProtocolID{Org3GPP, 0x00, 0x00, 0x00, 0x08} // GBA Digest in TS 33.220 Annex M
+)
+
+var uaProtocolNames = map[UaSecurityProtocolID]string{
+	UaSubscriberCertificate: "subscriber certificate",
+	UaMBMS:                  "MBMS",
+	UaHTTPDigest:            "HTTP digest",
+	UaMBMSHTTP:              "MBMS user service with HTTP",
+	UaMBMSSIP:               "MBMS user service with SIP",
+	UaGenericPush:           "generic push layer",
+	UaIMSMediaKMS:           "IMS media plane security KMS",
+	UaTMPI:                  "TMPI generation",
+	UaGBADigest:             "GBA Digest",
+}
+
+// pskCipherSuites is name of shared-key TLS cipher suites of TS 33.222 that crypto/tls does not know
+var pskCipherSuites = map[uint16]string{
+	0x008a: "TLS_PSK_WITH_RC4_128_SHA",
+	0x008b: "TLS_PSK_WITH_3DES_EDE_CBC_SHA",
+	0x008c: "TLS_PSK_WITH_AES_128_CBC_SHA",
+	0x008d: "TLS_PSK_WITH_AES_256_CBC_SHA",
+	0x00a8: "TLS_PSK_WITH_AES_128_GCM_SHA256",
+	0x00a9: "TLS_PSK_WITH_AES_256_GCM_SHA384",
+	0x00ae: "TLS_PSK_WITH_AES_128_CBC_SHA256",
+	0x00af: "TLS_PSK_WITH_AES_256_CBC_SHA384",
+}
+
+// UaTLS returns Ua security protocol identifier of TS 33.222 for the certificate based TLS cipher suite.
+// TLS 1.3 cipher suites use the same format.
+func UaTLS(cs uint16) UaSecurityProtocolID {
+	return UaSecurityProtocolID{Org3GPP, 0x00, 0x01, byte(cs >> 8), byte(cs)}
+}
+
+// UaSharedKeyTLS returns Ua security protocol identifier of TS 33.222 for the shared-key TLS cipher suite
+func UaSharedKeyTLS(cs uint16) UaSecurityProtocolID {
+	return UaSecurityProtocolID{Org3GPP, 0x00, 0x02, byte(cs >> 8), byte(cs)}
+}
+
+// UaFromConnection returns Ua security protocol identifier of HTTP digest over the connection
+func UaFromConnection(cs *tls.ConnectionState) UaSecurityProtocolID {
+	if cs == nil {
+		return UaHTTPDigest
+	}
+	if _, ok := pskCipherSuites[cs.CipherSuite]; ok {
+		return UaSharedKeyTLS(cs.CipherSuite)
+	}
+	return UaTLS(cs.CipherSuite)
+}
+
+// TLSCipherSuite returns TLS cipher suite of the identifier, ok is false if it is not TLS.
+// psk is true for shared-key TLS.
+func (id UaSecurityProtocolID) TLSCipherSuite() (cs uint16, psk, ok bool) {
+	if id[0] != Org3GPP || id[1] != 0x00 || (id[2] != 0x01 && id[2] != 0x02) {
+		return 0, false, false
+	}
+	return uint16(id[3])<<8 | uint16(id[4]), id[2] == 0x02, true
+}
+
+func (id UaSecurityProtocolID) String() string {
+	if n, ok := uaProtocolNames[id]; ok {
+		return n
+	}
+	if cs, psk, ok := id.TLSCipherSuite(); ok && psk {
+		if n, ok := pskCipherSuites[cs]; ok {
+			return n
+		}
+		return fmt.Sprintf("shared-key TLS(0x%04X)", cs)
+	} else if ok {
+		return tls.CipherSuiteName(cs)
+	}
+	return fmt.Sprintf("unknown(%x)", id[:])
+}
+
+// NAFID is NAF_ID = FQDN of NAF || Ua security protocol identifier
+type NAFID struct {
+	FQDN  string
+	UaSPI UaSecurityProtocolID
+}
+
+// Bytes returns NAF_ID value of TS 33.220
+func (n NAFID) Bytes() []byte {
+	return append([]byte(n.FQDN), n.UaSPI[:]...)
+}
+
+func (n NAFID) String() string {
+	return n.FQDN + " (" + n.UaSPI.String() + ")"
+}
+
+// ParseNAFID returns NAFID from NAF_ID value
+func ParseNAFID(b []byte) (n NAFID, e error) {
+	if len(b) <= 5 {
+		e = ErrInvalidNAFID
+		return
+	}
+	n.FQDN = string(b[:len(b)-5])
+	copy(n.UaSPI[:], b[len(b)-5:])
+	return
+}
+
+// NAFIDFromRequest returns NAFID of the HTTP request to NAF
+func NAFIDFromRequest(host string, cs *tls.ConnectionState) NAFID {
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return NAFID{
+		FQDN:  strings.Trim(host, "[]"),
+		UaSPI: UaFromConnection(cs)}
+}
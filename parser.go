@@ -317,6 +317,11 @@ func (a Authorization) String() string {
 
 func (a *Authorization) SetResponse(method string, pwd, body []byte) {
 	a1 := md5.Sum(append([]byte(a.Username+":"+a.Realm+":"), pwd...))
+	a.SetDigestResponse(method, a1[:], body)
+}
+
+// SetDigestResponse sets response with H(A1) instead of password
+func (a *Authorization) SetDigestResponse(method string, ha1, body []byte) {
 	a2 := md5.Sum(body)
 	if a.Qop == "auth-int" {
 		a2 = md5.Sum([]byte(fmt.Sprintf("%s:%s:%s",
@@ -325,11 +330,35 @@ func (a *Authorization) SetResponse(method string, pwd, body []byte) {
 		a2 = md5.Sum([]byte(fmt.Sprintf("%s:%s", method, a.Uri)))
 	}
 	a.Response = md5.Sum([]byte(fmt.Sprintf("%x:%s:%08x:%s:%s:%x",
-		a1, a.Nonce, a.Nc, a.Cnonce, a.Qop, a2)))
+		ha1, a.Nonce, a.Nc, a.Cnonce, a.Qop, a2)))
+}
+
+// SetBootstrapNonce sets nonce of AKA as base64(RAND||AUTN||server data)
+func (a *Authorization) SetBootstrapNonce(rand, autn []byte, sd ...byte) {
+	n := append(append(append([]byte{}, rand...), autn...), sd...)
+	a.Nonce = base64.StdEncoding.EncodeToString(n)
 }
 
-func (a *Authorization) SetBootstrapNonce(rand, autn []byte) {
-	a.Nonce = base64.StdEncoding.EncodeToString(append(rand, autn...))
+// BootstrapNonce returns RAND, AUTN and server data in nonce of AKA
+func (a Authorization) BootstrapNonce() (rand, autn, sd []byte, e error) {
+	return parseBootstrapNonce(a.Nonce)
+}
+
+// BootstrapNonce returns RAND, AUTN and server data in nonce of AKA
+func (a WWWAuthenticate) BootstrapNonce() (rand, autn, sd []byte, e error) {
+	return parseBootstrapNonce(a.Nonce)
+}
+
+func parseBootstrapNonce(nonce string) (rand, autn, sd []byte, e error) {
+	d, e := base64.StdEncoding.DecodeString(nonce)
+	if e != nil {
+		return
+	}
+	if len(d) < 32 {
+		e = errors.New("nonce is shorter than RAND and AUTN")
+		return
+	}
+	return d[:16], d[16:32], d[32:], nil
 }
 
 type AuthenticationInfo struct {
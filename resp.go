@@ -2,156 +2,716 @@ package bag
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var (
-	respAddr = "localhost:6379"
-	respChan chan net.Conn
-	buf      *bufio.ReadWriter
-)
+// RedisStore is SessionStore on Redis 7 or later server accessed with RESP.
+// Session of B-TID is indexed with set of B-TIDs in "impi:" key.
+type RedisStore struct {
+	Addr     string        // Redis server, or seed node in Cluster mode
+	Username string        // ACL user, empty for default user
+	Password string        // AUTH with the password if not empty
+	DB       int           // SELECT the DB if not zero
+	Protocol int           // HELLO 3 for RESP3 if 3, RESP2 otherwise
+	TLS      *tls.Config   // TLS to Redis server if not nil, ServerName is host of each server if empty
+	Timeout  time.Duration // deadline of each call, no deadline if zero
+
+	Sentinels  []string // Sentinel addresses to discover master, Addr is not used if not empty
+	MasterName string   // master name monitored by the Sentinels
+	Cluster    bool     // Redis Cluster mode with MOVED and ASK redirection
+
+	size   int
+	pools  chan map[string]*respPool // connection pool of each server address
+	master chan string               // master address discovered by Sentinel, empty if unknown
+	slots  chan *clusterSlots        // server address of each hash slot, nil until loaded
+}
+
+type respConn struct {
+	net.Conn
+	*bufio.ReadWriter
+}
+
+// respPool is pool of connections to a server, nil for not connected slot
+type respPool struct {
+	conn chan *respConn
+}
+
+// DefaultPoolSize is default number of connections of RedisStore
+var DefaultPoolSize = 16
+
+// NewRedisStore returns RedisStore of the Redis server address with the pool size
+func NewRedisStore(addr string, size int) *RedisStore {
+	if size <= 0 {
+		size = DefaultPoolSize
+	}
+	r := &RedisStore{
+		Addr:    addr,
+		Timeout: time.Second * 3,
+		size:    size,
+		pools:   make(chan map[string]*respPool, 1),
+		master:  make(chan string, 1),
+		slots:   make(chan *clusterSlots, 1)}
+	r.pools <- map[string]*respPool{}
+	r.master <- ""
+	r.slots <- nil
+	return r
+}
+
+// ParseRedisURL returns RedisStore of redis://[user:password@]host:port[/db][?protocol=3].
+// rediss scheme is used for TLS.
+func ParseRedisURL(s string, size int) (r *RedisStore, e error) {
+	u, e := url.Parse(s)
+	if e != nil {
+		return
+	}
+	if (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		e = fmt.Errorf("invalid Redis URL %s", s)
+		return
+	}
+	r = NewRedisStore(u.Host, size)
+	if u.Port() == "" {
+		r.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			r.Username = u.User.Username()
+			r.Password = p
+		} else {
+			r.Password = u.User.Username()
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if r.DB, e = strconv.Atoi(db); e != nil {
+			e = fmt.Errorf("invalid Redis DB %s", db)
+			return
+		}
+	}
+	if p := u.Query().Get("protocol"); p != "" {
+		if r.Protocol, e = strconv.Atoi(p); e != nil || (r.Protocol != 2 && r.Protocol != 3) {
+			e = fmt.Errorf("invalid RESP protocol %s", p)
+			return
+		}
+	}
+	if u.Scheme == "rediss" {
+		// host is master name in Sentinel mode and seed node in Cluster mode
+		r.TLS = &tls.Config{}
+	}
+	return
+}
+
+// RedisError is error reply of Redis, such as "ERR unknown command" or "MOVED 3999 host:port"
+type RedisError struct {
+	Kind    string // first word of the error, ERR, WRONGTYPE, NOAUTH, MOVED, ...
+	Message string
+}
+
+func (e RedisError) Error() string {
+	if e.Message == "" {
+		return e.Kind
+	}
+	return e.Kind + " " + e.Message
+}
+
+func parseRedisError(s string) RedisError {
+	k, m, _ := strings.Cut(s, " ")
+	return RedisError{Kind: k, Message: m}
+}
+
+// isUnavailable returns true if the error means the server is down or not master anymore
+func isUnavailable(e error) bool {
+	if e == nil {
+		return false
+	}
+	if re, ok := e.(RedisError); ok {
+		return re.Kind == "READONLY" || re.Kind == "LOADING" ||
+			re.Kind == "MASTERDOWN" || re.Kind == "CLUSTERDOWN"
+	}
+	return true
+}
+
+// errNotSent is error before the commands are sent to the server
+type errNotSent struct{ error }
+
+// retryable returns true if the commands can be sent again after the error of isUnavailable.
+// EVAL is not idempotent, so it is not sent again if the server may have run it.
+func retryable(cmds [][]string, e error) bool {
+	switch e.(type) {
+	case RedisError, errNotSent:
+		return true
+	}
+	for _, c := range cmds {
+		if strings.EqualFold(c[0], "EVAL") {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *RedisStore) connect(addr string) (c *respConn, e error) {
+	d := &net.Dialer{Timeout: r.Timeout}
+	var nc net.Conn
+	if r.TLS != nil {
+		conf := r.TLS
+		if conf.ServerName == "" {
+			conf = conf.Clone()
+			conf.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		nc, e = tls.DialWithDialer(d, "tcp", addr, conf)
+	} else {
+		nc, e = d.Dial("tcp", addr)
+	}
+	if e != nil {
+		return
+	}
+	c = &respConn{
+		Conn:       nc,
+		ReadWriter: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))}
+	return
+}
+
+func (r *RedisStore) dial(addr string) (c *respConn, e error) {
+	if c, e = r.connect(addr); e != nil {
+		return
+	}
+
+	var cmds [][]string
+	if r.Protocol == 3 {
+		hello := []string{"HELLO", "3"}
+		if r.Password != "" {
+			u := r.Username
+			if u == "" {
+				u = "default"
+			}
+			hello = append(hello, "AUTH", u, r.Password)
+		}
+		cmds = append(cmds, hello)
+	} else if r.Username != "" {
+		cmds = append(cmds, []string{"AUTH", r.Username, r.Password})
+	} else if r.Password != "" {
+		cmds = append(cmds, []string{"AUTH", r.Password})
+	}
+	if r.DB != 0 && !r.Cluster {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(r.DB)})
+	}
+	if len(cmds) != 0 {
+		if r.Timeout != 0 {
+			c.SetDeadline(time.Now().Add(r.Timeout))
+		}
+		if _, e = c.pipeline(cmds...); e != nil {
+			c.Close()
+			c = nil
+		}
+	}
+	return
+}
 
-func init() {
-	respChan = make(chan net.Conn, 1)
-	respChan <- nil
+// pipeline sends the commands and returns replies in one round trip.
+// Error reply of each command is returned as RedisError in the replies,
+// and first one is also returned as error.
+func (c *respConn) pipeline(cmds ...[]string) (v []any, e error) {
+	for _, args := range cmds {
+		fmt.Fprintf(c, "*%d\r\n", len(args))
+		for _, s := range args {
+			fmt.Fprintf(c, "$%d\r\n%s\r\n", len(s), s)
+		}
+	}
+	if e = c.Flush(); e != nil {
+		return
+	}
+
+	v = make([]any, len(cmds))
+	var re error
+	for i := range v {
+		for {
+			if v[i], e = readReply(c.Reader); e != nil {
+				return
+			}
+			// skip out-of-band push data of RESP3
+			if _, ok := v[i].(respPush); !ok {
+				break
+			}
+		}
+		if err, ok := v[i].(RedisError); ok && re == nil {
+			re = err
+		}
+	}
+	return v, re
 }
 
-func getCachedAV(id string) (av AV, ttl time.Time, e error) {
-	c := <-respChan
+func (r *RedisStore) pool(addr string) *respPool {
+	m := <-r.pools
+	defer func() { r.pools <- m }()
+
+	p, ok := m[addr]
+	if !ok {
+		p = &respPool{conn: make(chan *respConn, r.size)}
+		for i := 0; i < r.size; i++ {
+			p.conn <- nil
+		}
+		m[addr] = p
+	}
+	return p
+}
+
+// closePool closes idle connections to the server and removes its pool
+func (r *RedisStore) closePool(addr string) {
+	m := <-r.pools
+	p, ok := m[addr]
+	delete(m, addr)
+	r.pools <- m
+
+	for ok {
+		select {
+		case c := <-p.conn:
+			if c != nil {
+				c.Close()
+			}
+		default:
+			ok = false
+		}
+	}
+}
+
+// exec sends the commands to the server with a connection from the pool
+func (r *RedisStore) exec(addr string, cmds ...[]string) (v []any, e error) {
+	p := r.pool(addr)
+	c := <-p.conn
 	defer func() {
-		if e != nil {
+		if _, ok := e.(RedisError); e != nil && !ok && c != nil {
 			c.Close()
 			c = nil
 		}
-		respChan <- c
+		p.conn <- c
 	}()
 
 	if c == nil {
-		c, e = net.Dial("tcp", respAddr)
-		if e != nil {
+		if c, e = r.dial(addr); e != nil {
+			if _, ok := e.(RedisError); !ok {
+				e = errNotSent{e}
+			}
 			return
 		}
-		buf = bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
 	}
+	if r.Timeout != 0 {
+		c.SetDeadline(time.Now().Add(r.Timeout))
+	}
+	return c.pipeline(cmds...)
+}
 
-	_, e = fmt.Fprintf(buf, "*2\r\n$3\r\nGET\r\n$%d\r\n%s\r\n", len(id), id)
-	if e != nil {
-		return
+// pipeline sends the commands to the master, or to the nodes of the keys in Cluster mode
+func (r *RedisStore) pipeline(cmds ...[]string) ([]any, error) {
+	if r.Cluster {
+		return r.clusterPipeline(cmds)
 	}
-	e = buf.Flush()
-	if e != nil {
-		return
+	if len(r.Sentinels) != 0 {
+		return r.sentinelPipeline(cmds)
+	}
+	return r.exec(r.Addr, cmds...)
+}
+
+// do sends the command and returns the reply
+func (r *RedisStore) do(args ...string) (any, error) {
+	v, e := r.pipeline(args)
+	if len(v) != 1 {
+		return nil, e
 	}
+	return v[0], e
+}
+
+// respPush is out-of-band push data of RESP3
+type respPush []any
 
+// readReply returns reply as nil, string, int64, float64, bool, []byte, []any, map[string]any or RedisError
+func readReply(buf *bufio.Reader) (v any, e error) {
 	line, e := buf.ReadString('\n')
 	if e != nil {
 		return
 	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("unexpected result")
+	}
 	switch line[0] {
 	case '_': // Null
-		return
-	case '$': // Bulk String
-		var s int
-		s, e = strconv.Atoi(strings.TrimSpace(string(line[1:])))
-		if e != nil {
-			return
+		return nil, nil
+	case '+': // Simple String
+		return line[1:], nil
+	case '-': // Error
+		return parseRedisError(line[1:]), nil
+	case ':': // Integer
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '(': // Big number
+		return line[1:], nil
+	case ',': // Double
+		return strconv.ParseFloat(line[1:], 64)
+	case '#': // Boolean
+		return line[1:] == "t", nil
+	case '$', '=', '!': // Bulk String, Verbatim String, Bulk Error
+		var l int
+		if l, e = strconv.Atoi(line[1:]); e != nil || l < 0 {
+			return nil, e
 		}
-		if s < 0 {
+		data := make([]byte, l+2)
+		if _, e = io.ReadFull(buf, data); e != nil {
 			return
 		}
-
-		data := make([]byte, s)
-		_, e = buf.Read(data)
-		if e != nil {
-			return
+		data = data[:l]
+		switch line[0] {
+		case '=':
+			// skip encoding type such as "txt:"
+			if len(data) >= 4 {
+				data = data[4:]
+			}
+		case '!':
+			return parseRedisError(string(data)), nil
 		}
-		_, e = buf.ReadString('\n')
-		if e != nil {
-			return
+		return data, nil
+	case '*', '~', '>': // Array, Set, Push
+		var l int
+		if l, e = strconv.Atoi(line[1:]); e != nil || l < 0 {
+			return nil, e
 		}
-
-		e = av.UnmarshalText(data)
-		if e != nil {
-			av = AV{}
+		a := make([]any, l)
+		for i := range a {
+			if a[i], e = readReply(buf); e != nil {
+				return
+			}
 		}
-	default: // Others
-		e = errors.New("unexpected result")
-		return
+		if line[0] == '>' {
+			return respPush(a), nil
+		}
+		return a, nil
+	case '%', '|': // Map, Attribute
+		var l int
+		if l, e = strconv.Atoi(line[1:]); e != nil || l < 0 {
+			return nil, e
+		}
+		m := make(map[string]any, l)
+		for i := 0; i < l; i++ {
+			var k, val any
+			if k, e = readReply(buf); e != nil {
+				return
+			}
+			if val, e = readReply(buf); e != nil {
+				return
+			}
+			m[fmt.Sprint(respString(k))] = val
+		}
+		if line[0] == '|' {
+			// attribute is followed by the actual reply
+			return readReply(buf)
+		}
+		return m, nil
+	}
+	return nil, errors.New("unexpected result")
+}
+
+func respString(v any) any {
+	if b, ok := v.([]byte); ok {
+		return string(b)
 	}
+	return v
+}
 
-	_, e = fmt.Fprintf(buf, "*2\r\n$3\r\nTTL\r\n$%d\r\n%s\r\n", len(id), id)
+func (r *RedisStore) GetSession(btid string) (Session, time.Time, error) {
+	data, ttl, e := r.Get(btid)
 	if e != nil {
-		return
+		return Session{}, time.Time{}, e
 	}
-	e = buf.Flush()
+	return parseSession(btid, data, ttl)
+}
+
+func (r *RedisStore) SetSession(btid string, s Session, ttl time.Time) error {
+	v, e := marshalSession(btid, s)
 	if e != nil {
-		return
+		return e
 	}
 
-	line, e = buf.ReadString('\n')
+	// index expires with the last session of the IMPI
+	key := "impi:" + s.AV.IMPI
+	t := strconv.FormatInt(ttl.Unix(), 10)
+	_, e = r.pipeline(
+		[]string{"SET", btid, string(v), "EXAT", t},
+		[]string{"SADD", key, btid},
+		[]string{"EXPIREAT", key, t, "NX"},
+		[]string{"EXPIREAT", key, t, "GT"})
+	return e
+}
+
+func (r *RedisStore) DeleteSession(btid string) error {
+	data, _, e := r.Get(btid)
+	if e != nil || data == nil {
+		return e
+	}
+	s, _ := unmarshalSession(btid, data, true)
+	cmds := [][]string{{"DEL", btid}}
+	if s.AV.IMPI != "" {
+		cmds = append(cmds, []string{"SREM", "impi:" + s.AV.IMPI, btid})
+	}
+	_, e = r.pipeline(cmds...)
+	return e
+}
+
+func (r *RedisStore) ListSessions(impi string) (ret []string, e error) {
+	v, e := r.do("SMEMBERS", "impi:"+impi)
 	if e != nil {
 		return
 	}
-	switch line[0] {
-	case ':': // Integer
-		var s int
-		s, e = strconv.Atoi(strings.TrimSpace(string(line[1:])))
-		if e != nil || s < 0 {
+	var ids []string
+	var cmds [][]string
+	members, _ := v.([]any)
+	for _, m := range members {
+		if b, ok := m.([]byte); ok {
+			ids = append(ids, string(b))
+			cmds = append(cmds, []string{"EXISTS", string(b)})
+		}
+	}
+	if len(cmds) == 0 {
+		return
+	}
+	ex, e := r.pipeline(cmds...)
+	if e != nil {
+		return
+	}
+
+	var stale [][]string
+	for i, id := range ids {
+		if ex[i] == int64(1) {
+			ret = append(ret, id)
+		} else {
+			stale = append(stale, []string{"SREM", "impi:" + impi, id})
+		}
+	}
+	if len(stale) != 0 {
+		r.pipeline(stale...)
+	}
+	return
+}
+
+func (r *RedisStore) IMPIs() (ret []string, e error) {
+	var nodes []string
+	switch {
+	case r.Cluster:
+		if e = r.refreshSlots(); e != nil {
+			return
+		}
+		nodes = r.clusterNodes()
+	case len(r.Sentinels) != 0:
+		var m string
+		if m, e = r.masterAddr(); e != nil {
 			return
 		}
-		ttl = time.Now().UTC().Add(time.Second * time.Duration(s))
-	default: // Others
+		nodes = []string{m}
+	default:
+		nodes = []string{r.Addr}
+	}
+
+	for _, n := range nodes {
+		cursor := "0"
+		for {
+			var v []any
+			if v, e = r.exec(n, []string{"SCAN", cursor, "MATCH", "impi:*", "COUNT", "1000"}); e != nil {
+				return
+			}
+			a, ok := v[0].([]any)
+			if !ok || len(a) != 2 {
+				e = errors.New("unexpected result")
+				return
+			}
+			c, _ := a[0].([]byte)
+			keys, _ := a[1].([]any)
+			for _, k := range keys {
+				if b, ok := k.([]byte); ok {
+					ret = append(ret, strings.TrimPrefix(string(b), "impi:"))
+				}
+			}
+			if cursor = string(c); cursor == "0" || cursor == "" {
+				break
+			}
+		}
+	}
+	return
+}
+
+func (r *RedisStore) Get(key string) (data []byte, ttl time.Time, e error) {
+	v, e := r.pipeline([]string{"GET", key}, []string{"PTTL", key})
+	if e != nil || v[0] == nil {
+		return
+	}
+	data, ok := v[0].([]byte)
+	if !ok {
 		e = errors.New("unexpected result")
 		return
 	}
+	l, ok := v[1].(int64)
+	if !ok {
+		e = errors.New("unexpected result")
+	} else if l >= 0 {
+		ttl = time.Now().UTC().Add(time.Millisecond * time.Duration(l))
+	}
 	return
 }
 
-func setCachedAV(id string, av AV, ttl time.Time) (e error) {
-	c := <-respChan
-	defer func() {
-		if e != nil {
-			c.Close()
-			c = nil
+func (r *RedisStore) Set(key string, v []byte, ttl time.Time) error {
+	_, e := r.do("SET", key, string(v), "EXAT", strconv.FormatInt(ttl.Unix(), 10))
+	return e
+}
+
+// casScript replaces the data only if it is not changed
+const casScript = `if redis.call('GET', KEYS[1]) ~= ARGV[1] then return 0 end
+redis.call('SET', KEYS[1], ARGV[2], 'KEEPTTL')
+return 1`
+
+func (r *RedisStore) CompareAndSwap(key string, old, v []byte) (bool, error) {
+	res, e := r.do("EVAL", casScript, "1", key, string(old), string(v))
+	return res == int64(1), e
+}
+
+// ncScript accepts nc only if it is greater than the highest accepted nc
+// and the cnonce is not used yet for the nonce.
+const ncScript = `local nc = tonumber(redis.call('GET', KEYS[1]) or '0')
+if tonumber(ARGV[1]) <= nc then return 0 end
+if not redis.call('SET', KEYS[2], '1', 'NX', 'EXAT', ARGV[2]) then return 0 end
+redis.call('SET', KEYS[1], ARGV[1], 'EXAT', ARGV[2])
+return 1`
+
+func (r *RedisStore) AcceptNonceCount(id, cnonce string, nc uint64, ttl time.Time) (bool, error) {
+	// hash tag puts both keys in the same slot of Redis Cluster
+	v, e := r.do("EVAL", ncScript, "2", "nc:{"+id+"}", "cnonce:{"+id+"}:"+cnonce,
+		strconv.FormatUint(nc, 10), strconv.FormatInt(ttl.Unix(), 10))
+	return v == int64(1), e
+}
+
+func (r *RedisStore) PublishRevocation(btid string) error {
+	_, e := r.do("PUBLISH", RevocationChannel, btid)
+	return e
+}
+
+// SubscribeRevocation subscribes the channel with dedicated connection and reconnects on failure.
+// In Cluster mode, any node receives messages published in any node.
+func (r *RedisStore) SubscribeRevocation(f func(btid string)) {
+	go func() {
+		for {
+			e := r.subscribe(f)
+			Log("[ERR]", "Redis revocation subscription is closed:", e)
+			time.Sleep(time.Second)
 		}
-		respChan <- c
 	}()
+}
 
-	if c == nil {
-		c, e = net.Dial("tcp", respAddr)
-		if e != nil {
-			return
+// revocationPing is interval of PING on the subscription to detect failed server
+var revocationPing = time.Second * 10
+
+// subscribeAddrs returns candidate server addresses of the subscription
+func (r *RedisStore) subscribeAddrs() ([]string, error) {
+	if len(r.Sentinels) != 0 {
+		m, e := r.masterAddr()
+		return []string{m}, e
+	}
+	ret := []string{r.Addr}
+	if r.Cluster {
+		// seed node may be failed, so the other nodes are also tried
+		r.refreshSlots()
+		for _, n := range r.clusterNodes() {
+			if n != r.Addr {
+				ret = append(ret, n)
+			}
 		}
-		buf = bufio.NewReadWriter(bufio.NewReader(c), bufio.NewWriter(c))
 	}
+	return ret, nil
+}
 
-	t := strconv.FormatInt(ttl.Unix(), 10)
-	v, _ := av.MarshalText()
-	_, e = fmt.Fprintf(buf,
-		"*5\r\n$3\r\nSET\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n"+
-			"$4\r\nEXAT\r\n$%d\r\n%s\r\n",
-		len(id), id, len(v), v, len(t), t)
+func (r *RedisStore) subscribe(f func(btid string)) (e error) {
+	addrs, e := r.subscribeAddrs()
 	if e != nil {
 		return
 	}
-	e = buf.Flush()
-	if e != nil {
+	var c *respConn
+	var addr string
+	for _, addr = range addrs {
+		if c, e = r.dial(addr); e == nil {
+			break
+		}
+		if len(r.Sentinels) != 0 {
+			r.forgetMaster(addr)
+		}
+	}
+	if c == nil {
 		return
 	}
+	defer c.Close()
+	done := make(chan struct{})
+	defer close(done)
 
-	line, e := buf.ReadString('\n')
-	if e != nil {
-		return
+	if r.Timeout != 0 {
+		c.SetDeadline(time.Now().Add(r.Timeout))
 	}
-	switch line[0] {
-	case '$', '+', '-':
-		return
-	default:
+	// confirmation is push data in RESP3, so it is read in the loop
+	fmt.Fprintf(c, "*2\r\n$9\r\nSUBSCRIBE\r\n$%d\r\n%s\r\n",
+		len(RevocationChannel), RevocationChannel)
+	if e = c.Flush(); e != nil {
 		return
 	}
+
+	subscribed := false
+	for {
+		var v any
+		if v, e = readReply(c.Reader); e != nil {
+			return
+		}
+		if subscribed {
+			// PONG must be received before next PING
+			c.SetReadDeadline(time.Now().Add(revocationPing * 2))
+		}
+		var m []any
+		switch t := v.(type) {
+		case RedisError:
+			return t
+		case []any:
+			m = t
+		case respPush:
+			m = t
+		}
+		if len(m) != 3 {
+			continue
+		}
+		switch k, _ := m[0].([]byte); string(k) {
+		case "subscribe":
+			c.SetDeadline(time.Now().Add(revocationPing * 2))
+			subscribed = true
+			go c.ping(done)
+			Log("[INFO]", "subscribing revocation on Redis", addr)
+			// revocations may be published while not subscribing
+			f("")
+		case "message":
+			if btid, ok := m[2].([]byte); ok {
+				f(string(btid))
+			}
+		}
+	}
+}
+
+// ping sends PING on the subscription connection until done is closed
+func (c *respConn) ping(done chan struct{}) {
+	t := time.NewTicker(revocationPing)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		c.SetWriteDeadline(time.Now().Add(revocationPing))
+		if c.WriteString("*1\r\n$4\r\nPING\r\n"); c.Flush() != nil {
+			return
+		}
+	}
 }
@@ -0,0 +1,408 @@
+package bag
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is RESP server that answers each command with the handler.
+// asking is true if the previous command of the connection is ASKING.
+// Connection is closed without reply if the handler returns empty.
+type fakeRedis struct {
+	addr   string
+	handle func(cmd []string, asking bool) string
+	l      net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+	count map[string]int // number of received commands
+}
+
+func newFakeRedis(t *testing.T, conf *tls.Config, h func(cmd []string, asking bool) string) *fakeRedis {
+	l, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if conf != nil {
+		l = tls.NewListener(l, conf)
+	}
+	f := &fakeRedis{addr: l.Addr().String(), handle: h, l: l, count: map[string]int{}}
+	t.Cleanup(f.stop)
+	go func() {
+		for {
+			c, e := l.Accept()
+			if e != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, c)
+			f.mu.Unlock()
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+// stop closes the listener and all connections as failed server
+func (f *fakeRedis) stop() {
+	f.l.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	buf := bufio.NewReader(c)
+	asking := false
+	for {
+		v, e := readReply(buf)
+		if e != nil {
+			return
+		}
+		a, _ := v.([]any)
+		cmd := make([]string, len(a))
+		for i := range a {
+			b, _ := a[i].([]byte)
+			cmd[i] = string(b)
+		}
+		f.mu.Lock()
+		f.count[strings.ToUpper(cmd[0])]++
+		f.mu.Unlock()
+
+		r := f.handle(cmd, asking)
+		if r == "" {
+			return
+		}
+		asking = strings.EqualFold(cmd[0], "ASKING")
+		io.WriteString(c, r)
+	}
+}
+
+func (f *fakeRedis) received(cmd string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.count[cmd]
+}
+
+func respBulk(s string) string {
+	return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n"
+}
+
+func respArray(v ...string) string {
+	return "*" + strconv.Itoa(len(v)) + "\r\n" + strings.Join(v, "")
+}
+
+func respInt(i int) string {
+	return ":" + strconv.Itoa(i) + "\r\n"
+}
+
+// respSlots returns CLUSTER SLOTS reply of the slot ranges and the node addresses
+func respSlots(r ...any) string {
+	var a []string
+	for i := 0; i+2 < len(r); i += 3 {
+		h, p, _ := net.SplitHostPort(r[i+2].(string))
+		port, _ := strconv.Atoi(p)
+		a = append(a, respArray(respInt(r[i].(int)), respInt(r[i+1].(int)),
+			respArray(respBulk(h), respInt(port))))
+	}
+	return respArray(a...)
+}
+
+func TestClusterEvalNotRetried(t *testing.T) {
+	var f *fakeRedis
+	f = newFakeRedis(t, nil, func(cmd []string, _ bool) string {
+		switch strings.ToUpper(cmd[0]) {
+		case "CLUSTER":
+			return respSlots(0, 16383, f.addr)
+		case "EVAL", "GET":
+			// connection is lost after the command runs
+			return ""
+		}
+		return "+OK\r\n"
+	})
+	r := NewRedisStore(f.addr, 1)
+	r.Cluster = true
+	r.Timeout = time.Second
+
+	if _, e := r.AcceptNonceCount("n", "c", 1, time.Now().Add(time.Minute)); e == nil {
+		t.Error("lost EVAL succeeded")
+	}
+	if n := f.received("EVAL"); n != 1 {
+		t.Errorf("EVAL is sent %d times", n)
+	}
+	if _, _, e := r.Get("k"); e == nil {
+		t.Error("lost GET succeeded")
+	}
+	if n := f.received("GET"); n < 2 {
+		t.Errorf("idempotent GET is sent %d times", n)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	if c := crc16([]byte("123456789")); c != 0x31c3 {
+		t.Errorf("CRC16 %04x does not match 31c3", c)
+	}
+	for _, v := range []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 12739},
+		{"{123456789}.nc", 12739},
+		{"nc:{123456789}", 12739},
+		{"a{123456789}{b}", 12739},
+		{"foo{}bar", int(crc16([]byte("foo{}bar")) % 16384)},
+		{"foo{bar", int(crc16([]byte("foo{bar")) % 16384)},
+	} {
+		if s := keySlot(v.key); s != v.slot {
+			t.Errorf("slot of %s is %d, not %d", v.key, s, v.slot)
+		}
+	}
+	if k := commandKey([]string{"EVAL", "script", "2", "nc:{n}", "cnonce:{n}:c"}); k != "nc:{n}" {
+		t.Errorf("key of EVAL is %s", k)
+	}
+}
+
+func TestClusterRedirection(t *testing.T) {
+	slot := keySlot("k")
+	var a, b *fakeRedis
+	b = newFakeRedis(t, nil, func(cmd []string, asking bool) string {
+		switch strings.ToUpper(cmd[0]) {
+		case "GET":
+			if cmd[1] == "ask" && !asking {
+				return "-MOVED " + strconv.Itoa(keySlot("ask")) + " " + a.addr + "\r\n"
+			}
+			return respBulk("v")
+		case "PTTL":
+			return respInt(1000)
+		}
+		return "+OK\r\n"
+	})
+	a = newFakeRedis(t, nil, func(cmd []string, _ bool) string {
+		switch strings.ToUpper(cmd[0]) {
+		case "CLUSTER":
+			return respSlots(0, 16383, a.addr)
+		case "GET", "PTTL":
+			if cmd[1] == "ask" {
+				return "-ASK " + strconv.Itoa(keySlot("ask")) + " " + b.addr + "\r\n"
+			}
+			return "-MOVED " + strconv.Itoa(slot) + " " + b.addr + "\r\n"
+		}
+		return "+OK\r\n"
+	})
+	r := NewRedisStore(a.addr, 1)
+	r.Cluster = true
+
+	data, ttl, e := r.Get("k")
+	if e != nil || string(data) != "v" || ttl.IsZero() {
+		t.Fatalf("GET with MOVED returns %q, %s, %v", data, ttl, e)
+	}
+	if n := r.slotAddr(slot); n != b.addr {
+		t.Errorf("slot %d is not moved to %s, but %s", slot, b.addr, n)
+	}
+
+	if v, e := r.do("GET", "ask"); e != nil || string(v.([]byte)) != "v" {
+		t.Fatalf("GET with ASK returns %v, %v", v, e)
+	}
+	if n := r.slotAddr(keySlot("ask")); n != a.addr {
+		t.Errorf("slot of ASK is moved to %s", n)
+	}
+}
+
+func TestSentinelDiscovery(t *testing.T) {
+	role := func(r string) func([]string, bool) string {
+		return func(cmd []string, _ bool) string {
+			switch strings.ToUpper(cmd[0]) {
+			case "ROLE":
+				return respArray(respBulk(r))
+			case "SET":
+				if r != "master" {
+					return "-READONLY You can't write against a read only replica.\r\n"
+				}
+			}
+			return "+OK\r\n"
+		}
+	}
+	replica := newFakeRedis(t, nil, role("slave"))
+	master := newFakeRedis(t, nil, role("master"))
+	answer := func(f *fakeRedis) func([]string, bool) string {
+		return func(cmd []string, _ bool) string {
+			h, p, _ := net.SplitHostPort(f.addr)
+			return respArray(respBulk(h), respBulk(p))
+		}
+	}
+	// first Sentinel does not know failover yet
+	s1 := newFakeRedis(t, nil, answer(replica))
+	s2 := newFakeRedis(t, nil, answer(master))
+
+	r := NewRedisStore("", 1)
+	r.Sentinels = []string{s1.addr, s2.addr}
+	r.MasterName = "mymaster"
+	if m, e := r.masterAddr(); e != nil || m != master.addr {
+		t.Fatalf("master is %s, %v, not %s", m, e, master.addr)
+	}
+	if e := r.Set("k", []byte("v"), time.Now().Add(time.Minute)); e != nil {
+		t.Fatal(e)
+	}
+	if n := master.received("SET"); n != 1 {
+		t.Errorf("SET is sent %d times to master", n)
+	}
+	if n := replica.received("SET"); n != 0 {
+		t.Errorf("SET is sent %d times to replica", n)
+	}
+}
+
+func TestSentinelFailover(t *testing.T) {
+	mu := sync.Mutex{}
+	roles := map[string]string{}
+	node := func() *fakeRedis {
+		var f *fakeRedis
+		f = newFakeRedis(t, nil, func(cmd []string, _ bool) string {
+			mu.Lock()
+			r := roles[f.addr]
+			mu.Unlock()
+			switch strings.ToUpper(cmd[0]) {
+			case "ROLE":
+				return respArray(respBulk(r))
+			case "SET":
+				if r != "master" {
+					return "-READONLY You can't write against a read only replica.\r\n"
+				}
+			}
+			return "+OK\r\n"
+		})
+		return f
+	}
+	old, cur := node(), node()
+	roles[old.addr], roles[cur.addr] = "master", "slave"
+	master := old
+	s := newFakeRedis(t, nil, func(cmd []string, _ bool) string {
+		mu.Lock()
+		defer mu.Unlock()
+		h, p, _ := net.SplitHostPort(master.addr)
+		return respArray(respBulk(h), respBulk(p))
+	})
+
+	r := NewRedisStore("", 1)
+	r.Sentinels = []string{s.addr}
+	r.MasterName = "mymaster"
+	if e := r.Set("k", []byte("v"), time.Now().Add(time.Minute)); e != nil {
+		t.Fatal(e)
+	}
+
+	mu.Lock()
+	roles[old.addr], roles[cur.addr] = "slave", "master"
+	master = cur
+	mu.Unlock()
+	if e := r.Set("k", []byte("v"), time.Now().Add(time.Minute)); e != nil {
+		t.Fatal(e)
+	}
+	if n := cur.received("SET"); n != 1 {
+		t.Errorf("SET is sent %d times to new master", n)
+	}
+}
+
+func TestClusterSubscribe(t *testing.T) {
+	// subscription keeps running after the test, so the interval is not restored
+	revocationPing = time.Millisecond * 100
+
+	var seed, node *fakeRedis
+	slots := func(cmd []string, _ bool) string {
+		switch strings.ToUpper(cmd[0]) {
+		case "CLUSTER":
+			return respSlots(0, 8191, seed.addr, 8192, 16383, node.addr)
+		case "SUBSCRIBE":
+			return respArray(respBulk("subscribe"), respBulk(cmd[1]), respInt(1)) +
+				respArray(respBulk("message"), respBulk(cmd[1]), respBulk("btid"))
+		case "PING":
+			return respArray(respBulk("pong"), respBulk(""))
+		}
+		return "+OK\r\n"
+	}
+	seed = newFakeRedis(t, nil, slots)
+	node = newFakeRedis(t, nil, slots)
+
+	r := NewRedisStore(seed.addr, 1)
+	r.Cluster = true
+	if e := r.refreshSlots(); e != nil {
+		t.Fatal(e)
+	}
+	// seed node is failed after slot map is loaded
+	seed.stop()
+
+	ch := make(chan string, 4)
+	r.SubscribeRevocation(func(btid string) { ch <- btid })
+	for _, expect := range []string{"", "btid"} {
+		select {
+		case btid := <-ch:
+			if btid != expect {
+				t.Errorf("revoked B-TID is %q, not %q", btid, expect)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatal("revocation is not received from other node")
+		}
+	}
+	time.Sleep(revocationPing * 3)
+	if n := node.received("PING"); n == 0 {
+		t.Error("subscription is not kept alive with PING")
+	}
+}
+
+func TestTLSServerName(t *testing.T) {
+	// certificate is valid only for localhost, not for the master name
+	k, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	conf := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: k}}}
+
+	master := newFakeRedis(t, conf, func(cmd []string, _ bool) string {
+		if strings.EqualFold(cmd[0], "ROLE") {
+			return respArray(respBulk("master"))
+		}
+		return "+OK\r\n"
+	})
+	_, mp, _ := net.SplitHostPort(master.addr)
+	s := newFakeRedis(t, conf, func(cmd []string, _ bool) string {
+		return respArray(respBulk("localhost"), respBulk(mp))
+	})
+	_, sp, _ := net.SplitHostPort(s.addr)
+
+	r, e := ParseRedisURL("rediss://mymaster:6379", 1)
+	if e != nil {
+		t.Fatal(e)
+	}
+	r.TLS.RootCAs = pool
+	r.Sentinels = []string{"localhost:" + sp}
+	r.MasterName = "mymaster"
+	if e = r.Set("k", []byte("v"), time.Now().Add(time.Minute)); e != nil {
+		t.Fatal(e)
+	}
+}
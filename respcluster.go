@@ -0,0 +1,217 @@
+package bag
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// clusterSlots is server address of each hash slot of Redis Cluster
+type clusterSlots [16384]string
+
+// crc16 returns CRC16-CCITT (XMODEM) of the data used for hash slot
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keySlot returns hash slot of the key with hash tag in {}
+func keySlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16([]byte(key)) % 16384)
+}
+
+// commandKey returns first key of the command
+func commandKey(cmd []string) string {
+	switch {
+	case strings.EqualFold(cmd[0], "EVAL") && len(cmd) > 3:
+		return cmd[3]
+	case len(cmd) > 1:
+		return cmd[1]
+	}
+	return ""
+}
+
+// refreshSlots loads slot map with CLUSTER SLOTS from the seed node or a known node
+func (r *RedisStore) refreshSlots() (e error) {
+	nodes := append([]string{r.Addr}, r.clusterNodes()...)
+
+	e = errors.New("no Redis Cluster node is available")
+	for _, n := range nodes {
+		var v []any
+		if v, e = r.exec(n, []string{"CLUSTER", "SLOTS"}); e != nil {
+			continue
+		}
+		ranges, _ := v[0].([]any)
+		slots := new(clusterSlots)
+		for _, rg := range ranges {
+			a, ok := rg.([]any)
+			if !ok || len(a) < 3 {
+				continue
+			}
+			start, _ := a[0].(int64)
+			end, _ := a[1].(int64)
+			m, ok := a[2].([]any)
+			if !ok || len(m) < 2 || start < 0 || end >= int64(len(slots)) {
+				continue
+			}
+			host, _ := m[0].([]byte)
+			port, _ := m[1].(int64)
+			h := string(host)
+			if h == "" || h == "?" {
+				// same host as the node that answered
+				h, _, _ = net.SplitHostPort(n)
+			}
+			addr := net.JoinHostPort(h, strconv.FormatInt(port, 10))
+			for i := start; i <= end; i++ {
+				slots[i] = addr
+			}
+		}
+		<-r.slots
+		r.slots <- slots
+		return nil
+	}
+	return
+}
+
+// clusterNodes returns server addresses in the slot map
+func (r *RedisStore) clusterNodes() (ret []string) {
+	s := <-r.slots
+	defer func() { r.slots <- s }()
+
+	known := map[string]bool{}
+	for i := 0; s != nil && i < len(s); i++ {
+		if a := s[i]; a != "" && !known[a] {
+			known[a] = true
+			ret = append(ret, a)
+		}
+	}
+	return
+}
+
+func (r *RedisStore) slotsLoaded() bool {
+	s := <-r.slots
+	r.slots <- s
+	return s != nil
+}
+
+// slotAddr returns server address of the hash slot, seed node if unknown
+func (r *RedisStore) slotAddr(slot int) string {
+	s := <-r.slots
+	defer func() { r.slots <- s }()
+	if s == nil || s[slot] == "" {
+		return r.Addr
+	}
+	return s[slot]
+}
+
+func (r *RedisStore) setSlotAddr(slot int, addr string) {
+	s := <-r.slots
+	if s != nil && slot >= 0 && slot < len(s) {
+		s[slot] = addr
+	}
+	r.slots <- s
+}
+
+// clusterDo sends the command to the node of the key and follows MOVED and ASK redirection
+func (r *RedisStore) clusterDo(cmd []string) (v any, e error) {
+	addr := r.slotAddr(keySlot(commandKey(cmd)))
+	cmds := [][]string{cmd}
+	for i := 0; i < 5; i++ {
+		var rv []any
+		rv, e = r.exec(addr, cmds...)
+		if isUnavailable(e) {
+			// node may be failed over, reload slot map
+			if r.refreshSlots() != nil || !retryable(cmds, e) {
+				return
+			}
+			addr = r.slotAddr(keySlot(commandKey(cmd)))
+			cmds = [][]string{cmd}
+			continue
+		}
+		v = rv[len(rv)-1]
+		re, ok := v.(RedisError)
+		if !ok {
+			return v, nil
+		}
+		t := strings.Fields(re.Message)
+		if len(t) != 2 || (re.Kind != "MOVED" && re.Kind != "ASK") {
+			return v, re
+		}
+		addr = t[1]
+		if re.Kind == "MOVED" {
+			slot, _ := strconv.Atoi(t[0])
+			r.setSlotAddr(slot, addr)
+			cmds = [][]string{cmd}
+		} else {
+			// ASK is one time redirection during slot migration
+			cmds = [][]string{{"ASKING"}, cmd}
+		}
+	}
+	return
+}
+
+// clusterPipeline sends the commands in one pipeline to each node of the keys.
+// Redirected or failed command is sent again with clusterDo.
+func (r *RedisStore) clusterPipeline(cmds [][]string) (v []any, e error) {
+	if !r.slotsLoaded() {
+		r.refreshSlots()
+	}
+
+	groups := map[string][]int{}
+	for i, c := range cmds {
+		a := r.slotAddr(keySlot(commandKey(c)))
+		groups[a] = append(groups[a], i)
+	}
+
+	v = make([]any, len(cmds))
+	var retry []int
+	for addr, idx := range groups {
+		g := make([][]string, len(idx))
+		for j, i := range idx {
+			g[j] = cmds[i]
+		}
+		gv, err := r.exec(addr, g...)
+		if isUnavailable(err) && !retryable(g, err) {
+			r.refreshSlots()
+			return nil, err
+		} else if isUnavailable(err) {
+			retry = append(retry, idx...)
+			continue
+		}
+		for j, i := range idx {
+			v[i] = gv[j]
+			if re, ok := gv[j].(RedisError); ok && (re.Kind == "MOVED" || re.Kind == "ASK") {
+				retry = append(retry, i)
+			}
+		}
+	}
+	for _, i := range retry {
+		var err error
+		if v[i], err = r.clusterDo(cmds[i]); isUnavailable(err) {
+			return nil, err
+		}
+	}
+
+	for _, rv := range v {
+		if re, ok := rv.(RedisError); ok {
+			return v, re
+		}
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package bag
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// discoverMaster returns master address from the first Sentinel that knows the master
+func (r *RedisStore) discoverMaster() (addr string, e error) {
+	e = errors.New("no Sentinel is available")
+	for _, s := range r.Sentinels {
+		var c *respConn
+		if c, e = r.connect(s); e != nil {
+			continue
+		}
+		if r.Timeout != 0 {
+			c.SetDeadline(time.Now().Add(r.Timeout))
+		}
+		var v []any
+		v, e = c.pipeline([]string{"SENTINEL", "get-master-addr-by-name", r.MasterName})
+		c.Close()
+		if e != nil {
+			continue
+		}
+		if a, ok := v[0].([]any); ok && len(a) == 2 {
+			h, _ := a[0].([]byte)
+			p, _ := a[1].([]byte)
+			if len(h) != 0 && len(p) != 0 {
+				addr = net.JoinHostPort(string(h), string(p))
+				if e = r.confirmMaster(addr); e == nil {
+					return
+				}
+				continue
+			}
+		}
+		e = fmt.Errorf("master %s is unknown by Sentinel %s", r.MasterName, s)
+	}
+	return "", e
+}
+
+// confirmMaster checks ROLE of the server, because Sentinel may answer old master during failover
+func (r *RedisStore) confirmMaster(addr string) error {
+	v, e := r.exec(addr, []string{"ROLE"})
+	if e != nil {
+		return e
+	}
+	if a, ok := v[0].([]any); ok && len(a) != 0 {
+		if role, _ := a[0].([]byte); string(role) == "master" {
+			return nil
+		}
+	}
+	r.closePool(addr)
+	return fmt.Errorf("server %s is not Redis master", addr)
+}
+
+// masterAddr returns the master address, discovered by Sentinel if unknown
+func (r *RedisStore) masterAddr() (m string, e error) {
+	m = <-r.master
+	if m == "" {
+		if m, e = r.discoverMaster(); e == nil {
+			Log("[INFO]", "Redis master", r.MasterName, "is", m)
+		}
+	}
+	r.master <- m
+	return
+}
+
+// sentinelPipeline sends the commands to the master discovered by Sentinel.
+// The master is discovered again and the commands are retried once when the master is unavailable,
+// except commands that may have run.
+func (r *RedisStore) sentinelPipeline(cmds [][]string) (v []any, e error) {
+	for i := 0; i < 2; i++ {
+		var m string
+		if m, e = r.masterAddr(); e != nil {
+			return
+		}
+
+		if v, e = r.exec(m, cmds...); !isUnavailable(e) {
+			return
+		}
+		Log("[ERR]", "Redis master", m, "is unavailable:", e)
+		r.forgetMaster(m)
+		if !retryable(cmds, e) {
+			return
+		}
+	}
+	return
+}
+
+// forgetMaster clears the master address to discover again
+func (r *RedisStore) forgetMaster(m string) {
+	if cur := <-r.master; cur == m {
+		r.master <- ""
+		r.closePool(m)
+	} else {
+		r.master <- cur
+	}
+}
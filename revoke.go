@@ -0,0 +1,166 @@
+package bag
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RevocationChannel is pub/sub channel of revoked B-TIDs
+const RevocationChannel = "bag:revoked"
+
+// RevokeBTID removes the session of the B-TID and notifies all instances.
+// It returns false if the B-TID is unknown.
+func RevokeBTID(btid string) (bool, error) {
+	data, ttl, e := Store.Get(btid)
+	if e != nil || data == nil || ttl.IsZero() {
+		return false, e
+	}
+	if e = Store.DeleteSession(btid); e != nil {
+		return false, e
+	}
+	Log("[INFO]", "B-TID", btid, "is revoked")
+	return true, Store.PublishRevocation(btid)
+}
+
+// RevokeIMPI removes all sessions of the IMPI and notifies all instances.
+// It returns revoked B-TIDs.
+func RevokeIMPI(impi string) (ret []string, e error) {
+	ids, e := Store.ListSessions(impi)
+	if e != nil {
+		return
+	}
+	for _, id := range ids {
+		var ok bool
+		if ok, e = RevokeBTID(id); e != nil {
+			return
+		} else if ok {
+			ret = append(ret, id)
+		}
+	}
+	return
+}
+
+// NAFKeyCache enables cache of Ks_NAF in NAF.
+// Cached key is dropped when the B-TID is revoked, so the store must be shared with BSF.
+var NAFKeyCache = false
+
+type nafKeyID struct {
+	nafid string
+	uicc  bool
+}
+
+// nafKeys is cached keys of NAF_ID for each B-TID
+var nafKeys = make(chan map[string]map[nafKeyID]NAFKey, 1)
+
+func init() {
+	nafKeys <- map[string]map[nafKeyID]NAFKey{}
+}
+
+func cachedNAFKey(btid string, nafid NAFID, uicc bool) (k NAFKey, ok bool) {
+	m := <-nafKeys
+	defer func() { nafKeys <- m }()
+
+	id := nafKeyID{nafid: string(nafid.Bytes()), uicc: uicc}
+	if k, ok = m[btid][id]; ok && !k.Expire.After(time.Now()) {
+		delete(m[btid], id)
+		ok = false
+	}
+	return
+}
+
+func cacheNAFKey(btid string, nafid NAFID, uicc bool, k NAFKey) {
+	m := <-nafKeys
+	defer func() { nafKeys <- m }()
+
+	if m[btid] == nil {
+		m[btid] = map[nafKeyID]NAFKey{}
+	}
+	m[btid][nafKeyID{nafid: string(nafid.Bytes()), uicc: uicc}] = k
+}
+
+// dropNAFKeys removes cached keys of the B-TID, or all keys if btid is empty
+func dropNAFKeys(btid string) {
+	m := <-nafKeys
+	if btid == "" {
+		m = map[string]map[nafKeyID]NAFKey{}
+	} else {
+		delete(m, btid)
+	}
+	nafKeys <- m
+}
+
+// sweepNAFKeys removes expired keys in the cache
+func sweepNAFKeys() {
+	m := <-nafKeys
+	defer func() { nafKeys <- m }()
+
+	now := time.Now()
+	for btid, keys := range m {
+		for id, k := range keys {
+			if !k.Expire.After(now) {
+				delete(keys, id)
+			}
+		}
+		if len(keys) == 0 {
+			delete(m, btid)
+		}
+	}
+}
+
+// ListenRevocation drops cached Ks_NAF of B-TIDs revoked in any instance
+func ListenRevocation() {
+	Store.SubscribeRevocation(dropNAFKeys)
+	go func() {
+		for range time.Tick(time.Minute) {
+			sweepNAFKeys()
+		}
+	}()
+}
+
+// RevocationHandler revokes sessions with DELETE /btid/{B-TID} or DELETE /impi/{IMPI}.
+// It must be served with TLS that verifies client certificate.
+func RevocationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", productName+" BSF")
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		Log("[INFO]", "revocation request from", r.RemoteAddr, "rejected:", "no verified client certificate")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var ids []string
+	var e error
+	if btid, ok := strings.CutPrefix(r.URL.Path, "/btid/"); ok && btid != "" {
+		var revoked bool
+		if revoked, e = RevokeBTID(btid); revoked {
+			ids = []string{btid}
+		}
+	} else if impi, ok := strings.CutPrefix(r.URL.Path, "/impi/"); ok && impi != "" {
+		ids, e = RevokeIMPI(impi)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if e != nil {
+		Log("[ERR]", "revocation of", r.URL.Path, "failed:", e)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(ids) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	data, _ := json.Marshal(struct {
+		Revoked []string `json:"revoked"`
+	}{ids})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
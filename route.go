@@ -0,0 +1,189 @@
+package bag
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Route is forwarding destination and authorization policy of NAF
+type Route struct {
+	Host       string   `json:"host,omitempty"` // empty matches any host
+	PathPrefix string   `json:"path,omitempty"` // matches on path segment boundary
+	Upstream   string   `json:"upstream"`
+	RequireTLS bool     `json:"requireTLS,omitempty"`
+	Qop        []string `json:"qop,omitempty"`       // allowed qop, empty allows default
+	IMPU       []string `json:"impu,omitempty"`      // allowed IMPU patterns in GUSS, empty allows any
+	Flags      []int    `json:"gussFlags,omitempty"` // required USS flags in GUSS
+	NAFGroup   string   `json:"nafGroup,omitempty"`  // required NAF group of USS in GUSS
+	UICCKey    bool     `json:"uiccKey,omitempty"`   // use Ks_int_NAF of GBA_U
+
+	upstream *url.URL
+}
+
+// Routes is route table of NAF. Upstream is used for all request if empty.
+var Routes []Route
+
+// LoadRoutes read route table of NAF from JSON file
+func LoadRoutes(file string) error {
+	data, e := os.ReadFile(file)
+	if e != nil {
+		return e
+	}
+	rt := []Route{}
+	if e = json.Unmarshal(data, &rt); e != nil {
+		return e
+	}
+	for i := range rt {
+		u, e := url.Parse(rt[i].Upstream)
+		if e != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid upstream URL %s", rt[i].Upstream)
+		}
+		rt[i].upstream = u
+		for _, q := range rt[i].Qop {
+			if q != "auth" && q != "auth-int" {
+				return fmt.Errorf("invalid qop %s", q)
+			}
+		}
+		for _, p := range rt[i].IMPU {
+			if _, e = path.Match(p, ""); e != nil {
+				return fmt.Errorf("invalid IMPU pattern %s", p)
+			}
+		}
+	}
+	Routes = rt
+	return nil
+}
+
+func matchRoute(r *http.Request) (*Route, error) {
+	if len(Routes) == 0 {
+		return &Route{upstream: Upstream}, nil
+	}
+	host := r.Host
+	if strings.Contains(host, ":") {
+		host, _, _ = net.SplitHostPort(host)
+	}
+
+	var ret *Route
+	for i, rt := range Routes {
+		if rt.Host != "" && !strings.EqualFold(rt.Host, host) {
+			continue
+		}
+		if !matchPath(r.URL.Path, rt.PathPrefix) {
+			continue
+		}
+		if ret == nil || len(rt.PathPrefix) > len(ret.PathPrefix) ||
+			(ret.Host == "" && rt.Host != "" && len(rt.PathPrefix) == len(ret.PathPrefix)) {
+			ret = &Routes[i]
+		}
+	}
+	if ret == nil {
+		return nil, errors.New("no route for " + host + r.URL.Path)
+	}
+	return ret, nil
+}
+
+// matchPath returns true if the prefix is same as the path or its parent path segments
+func matchPath(p, prefix string) bool {
+	if !strings.HasPrefix(p, prefix) {
+		return false
+	}
+	return len(p) == len(prefix) || prefix == "" ||
+		strings.HasSuffix(prefix, "/") || p[len(prefix)] == '/'
+}
+
+func (rt *Route) qop() []string {
+	if len(rt.Qop) == 0 {
+		return qop
+	}
+	return rt.Qop
+}
+
+// authorize checks the request with the policy of the route.
+// It returns the identities allowed by IMPU patterns, or nil if the route has no IMPU pattern.
+func (rt *Route) authorize(auth Authorization, key NAFKey, ids []string) ([]string, error) {
+	if len(rt.Qop) != 0 {
+		ok := false
+		for _, q := range rt.Qop {
+			ok = ok || q == auth.Qop
+		}
+		if !ok {
+			return nil, fmt.Errorf("qop %s is not allowed", auth.Qop)
+		}
+	}
+
+	var allowed []string
+	if len(rt.IMPU) != 0 {
+		// intended identities are given by UE, so they must be IMPUs in GUSS
+		impus := key.GUSS.IMPUs()
+		if len(impus) == 0 {
+			return nil, errors.New("no IMPU for the subscriber")
+		}
+	owned:
+		for _, id := range ids {
+			for _, impu := range impus {
+				if id == impu {
+					continue owned
+				}
+			}
+			return nil, fmt.Errorf("identity %s is not owned by the subscriber", id)
+		}
+		for _, id := range ids {
+			if !rt.matchIMPU(id) {
+				return nil, fmt.Errorf("IMPU %s is not allowed", id)
+			}
+		}
+		allowed = ids
+		if len(ids) == 0 {
+			// any IMPU of the subscriber is used if UE does not intend
+			for _, impu := range impus {
+				if rt.matchIMPU(impu) {
+					allowed = []string{impu}
+					break
+				}
+			}
+			if len(allowed) == 0 {
+				return nil, errors.New("no allowed IMPU for the subscriber")
+			}
+		}
+	}
+
+	if len(rt.Flags) == 0 && rt.NAFGroup == "" {
+		return allowed, nil
+	}
+	if key.GUSS == nil {
+		return nil, errors.New("no GUSS for the subscriber")
+	}
+	for _, u := range key.GUSS.USSList {
+		if rt.NAFGroup != "" && u.NAFGroup != rt.NAFGroup {
+			continue
+		}
+		ok := true
+		for _, f := range rt.Flags {
+			found := false
+			for _, uf := range u.Flags {
+				found = found || uf == f
+			}
+			ok = ok && found
+		}
+		if ok {
+			return allowed, nil
+		}
+	}
+	return nil, fmt.Errorf("no USS for NAF group %s with flags %v", rt.NAFGroup, rt.Flags)
+}
+
+func (rt *Route) matchIMPU(id string) bool {
+	for _, p := range rt.IMPU {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
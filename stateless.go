@@ -0,0 +1,128 @@
+package bag
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// ChallengeKey is AES key of stateless BSF challenge.
+// If set, BSF seals XRES, CK, IK and offered qop into server data of the nonce
+// and writes bootstrapping session only after successful bootstrap.
+// The challenge still reads TMPI and GUSS cache and writes GUSS received from HSS,
+// and the used nonce is recorded after successful bootstrap to reject replay.
+var ChallengeKey []byte
+
+func challengeAEAD() (cipher.AEAD, error) {
+	b, e := aes.NewCipher(ChallengeKey)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(b)
+}
+
+func challengeAD(rand, autn []byte, impi, realm string) []byte {
+	ad := append(append([]byte{}, rand...), autn...)
+	ad = append(ad, impi...)
+	ad = append(ad, 0)
+	return append(ad, realm...)
+}
+
+func statelessOpaque(nonce string) string {
+	h := hmac.New(sha256.New, ChallengeKey)
+	h.Write([]byte("opaque:" + nonce))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+// statelessChallenge makes challenge with the AV, GBA type and offered qop sealed in the nonce
+func statelessChallenge(s Session, realm string, q []string) (c Challenge, e error) {
+	aead, e := challengeAEAD()
+	if e != nil {
+		return
+	}
+	c = Challenge{
+		Realm:  realm,
+		Issued: time.Now().UTC(),
+		Qop:    q}
+
+	av := s.AV
+	qs := strings.Join(q, ",")
+	pt := binary.BigEndian.AppendUint64(nil, uint64(c.Issued.Unix()))
+	pt = append(pt, byte(s.Type), byte(len(qs)))
+	pt = append(pt, qs...)
+	pt = append(pt, av.IK...)
+	pt = append(pt, av.CK...)
+	pt = append(pt, av.RES...)
+	iv := make([]byte, aead.NonceSize())
+	rand.Read(iv)
+	sd := aead.Seal(iv, iv, pt, challengeAD(av.RAND, av.AUTN, av.IMPI, realm))
+
+	a := Authorization{}
+	a.SetBootstrapNonce(av.RAND, av.AUTN, sd...)
+	c.Nonce = a.Nonce
+	c.Opaque = statelessOpaque(c.Nonce)
+	return
+}
+
+// openStatelessNonce returns the challenge with the AV and GBA type sealed in the nonce for the IMPI
+func openStatelessNonce(auth Authorization, impi string) (av AV, t GBAType, c Challenge, e error) {
+	aead, e := challengeAEAD()
+	if e != nil {
+		return
+	}
+	rand, autn, sd, e := auth.BootstrapNonce()
+	if e != nil || len(sd) < aead.NonceSize() {
+		e = errInvalidNonce
+		return
+	}
+	ns := aead.NonceSize()
+	pt, e := aead.Open(nil, sd[:ns], sd[ns:],
+		challengeAD(rand, autn, impi, auth.Realm))
+	if e != nil || len(pt) < 8+2 || len(pt) < 8+2+int(pt[9])+16+16 {
+		e = errInvalidNonce
+		return
+	}
+
+	c = Challenge{
+		Nonce:  auth.Nonce,
+		Opaque: statelessOpaque(auth.Nonce),
+		Realm:  auth.Realm,
+		Issued: time.Unix(int64(binary.BigEndian.Uint64(pt)), 0).UTC()}
+	t = GBAType(pt[8])
+	if l := int(pt[9]); l != 0 {
+		c.Qop = strings.Split(string(pt[10:10+l]), ",")
+	}
+	pt = pt[10+int(pt[9]):]
+	av = AV{
+		RAND: rand,
+		AUTN: autn,
+		IK:   pt[0:16],
+		CK:   pt[16:32],
+		RES:  pt[32:],
+		IMPI: impi}
+	return
+}
+
+// verifyStatelessChallenge checks the Authorization with the challenge sealed in the nonce
+func verifyStatelessChallenge(auth Authorization, c Challenge) error {
+	if !hmac.Equal([]byte(auth.Opaque), []byte(c.Opaque)) {
+		return errInvalidOpaque
+	}
+	ok := false
+	for _, q := range c.Qop {
+		ok = ok || q == auth.Qop
+	}
+	if !ok {
+		return errInvalidQop
+	}
+	if c.Issued.Add(Lifetime.Nonce).Before(time.Now()) {
+		return errStaleNonce
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package bag
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// SessionStore is storage of bootstrapping sessions and the other state of BSF and NAF
+type SessionStore interface {
+	// GetSession returns the session of the B-TID and its expiry, zero expiry if not found
+	GetSession(btid string) (Session, time.Time, error)
+	// SetSession stores the session of the B-TID until ttl
+	SetSession(btid string, s Session, ttl time.Time) error
+	// DeleteSession removes the session of the B-TID
+	DeleteSession(btid string) error
+	// ListSessions returns B-TIDs of the IMPI
+	ListSessions(impi string) ([]string, error)
+	// IMPIs returns IMPIs that have sessions
+	IMPIs() ([]string, error)
+
+	// Get returns the data and its expiry, zero expiry if not found
+	Get(key string) ([]byte, time.Time, error)
+	// Set stores the data until ttl
+	Set(key string, v []byte, ttl time.Time) error
+	// CompareAndSwap replaces the data with v and keeps its expiry only if the data is old.
+	// It returns false if the data is changed or removed.
+	CompareAndSwap(key string, old, v []byte) (bool, error)
+	// AcceptNonceCount records nc and cnonce of the id until ttl.
+	// It returns false if nc is not greater than the recorded one or the cnonce is used.
+	AcceptNonceCount(id, cnonce string, nc uint64, ttl time.Time) (bool, error)
+
+	// PublishRevocation notifies the revoked B-TID to all subscribers
+	PublishRevocation(btid string) error
+	// SubscribeRevocation calls f with revoked B-TID.
+	// f is called with empty B-TID when revocations may be lost.
+	SubscribeRevocation(f func(btid string))
+}
+
+// Store is session store of BSF and NAF
+var Store SessionStore = NewRedisStore("localhost:6379", 0)
+
+func parseSession(btid string, data []byte, ttl time.Time) (s Session, t time.Time, e error) {
+	if data == nil || ttl.IsZero() {
+		return
+	}
+	if s, e = unmarshalSession(btid, data, false); e != nil {
+		s = Session{}
+	} else {
+		t = ttl
+	}
+	return
+}
+
+type memoryEntry struct {
+	v   []byte
+	exp time.Time
+}
+
+type memoryState struct {
+	data     map[string]memoryEntry
+	impis    map[string]map[string]time.Time // B-TIDs and their expiry of the IMPI
+	handlers []func(string)                  // subscribers of revocation
+}
+
+// MemoryStore is SessionStore in this process for single node and lab use
+type MemoryStore struct {
+	state chan *memoryState
+}
+
+// NewMemoryStore returns MemoryStore that sweeps expired data in each interval
+func NewMemoryStore(interval time.Duration) *MemoryStore {
+	m := &MemoryStore{state: make(chan *memoryState, 1)}
+	m.state <- &memoryState{
+		data:  map[string]memoryEntry{},
+		impis: map[string]map[string]time.Time{}}
+
+	go func() {
+		for range time.Tick(interval) {
+			m.sweep()
+		}
+	}()
+	return m
+}
+
+func (m *MemoryStore) sweep() {
+	st := <-m.state
+	defer func() { m.state <- st }()
+
+	now := time.Now()
+	for k, v := range st.data {
+		if !v.exp.After(now) {
+			delete(st.data, k)
+		}
+	}
+	for impi, ids := range st.impis {
+		for id, exp := range ids {
+			if !exp.After(now) {
+				delete(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(st.impis, impi)
+		}
+	}
+}
+
+func (st *memoryState) get(key string) (memoryEntry, bool) {
+	v, ok := st.data[key]
+	if ok && !v.exp.After(time.Now()) {
+		delete(st.data, key)
+		ok = false
+	}
+	return v, ok
+}
+
+func (m *MemoryStore) GetSession(btid string) (Session, time.Time, error) {
+	data, ttl, _ := m.Get(btid)
+	return parseSession(btid, data, ttl)
+}
+
+func (m *MemoryStore) SetSession(btid string, s Session, ttl time.Time) error {
+	v, e := marshalSession(btid, s)
+	if e != nil {
+		return e
+	}
+	st := <-m.state
+	defer func() { m.state <- st }()
+
+	st.data[btid] = memoryEntry{v: v, exp: ttl}
+	if st.impis[s.AV.IMPI] == nil {
+		st.impis[s.AV.IMPI] = map[string]time.Time{}
+	}
+	st.impis[s.AV.IMPI][btid] = ttl
+	return nil
+}
+
+func (m *MemoryStore) DeleteSession(btid string) error {
+	st := <-m.state
+	defer func() { m.state <- st }()
+
+	if v, ok := st.get(btid); ok {
+		if s, e := unmarshalSession(btid, v.v, true); e == nil {
+			delete(st.impis[s.AV.IMPI], btid)
+		}
+	}
+	delete(st.data, btid)
+	return nil
+}
+
+func (m *MemoryStore) ListSessions(impi string) (ret []string, e error) {
+	st := <-m.state
+	defer func() { m.state <- st }()
+
+	for id := range st.impis[impi] {
+		if _, ok := st.get(id); ok {
+			ret = append(ret, id)
+		} else {
+			delete(st.impis[impi], id)
+		}
+	}
+	return
+}
+
+func (m *MemoryStore) IMPIs() (ret []string, e error) {
+	st := <-m.state
+	defer func() { m.state <- st }()
+
+	for impi, ids := range st.impis {
+		if len(ids) != 0 {
+			ret = append(ret, impi)
+		}
+	}
+	return
+}
+
+func (m *MemoryStore) Get(key string) (data []byte, ttl time.Time, e error) {
+	st := <-m.state
+	defer func() { m.state <- st }()
+
+	if v, ok := st.get(key); ok {
+		data = append([]byte{}, v.v...)
+		ttl = v.exp.UTC()
+	}
+	return
+}
+
+func (m *MemoryStore) Set(key string, v []byte, ttl time.Time) error {
+	st := <-m.state
+	defer func() { m.state <- st }()
+
+	st.data[key] = memoryEntry{v: append([]byte{}, v...), exp: ttl}
+	return nil
+}
+
+func (m *MemoryStore) CompareAndSwap(key string, old, v []byte) (bool, error) {
+	st := <-m.state
+	defer func() { m.state <- st }()
+
+	cur, ok := st.get(key)
+	if !ok || !bytes.Equal(cur.v, old) {
+		return false, nil
+	}
+	st.data[key] = memoryEntry{v: append([]byte{}, v...), exp: cur.exp}
+	return true, nil
+}
+
+func (m *MemoryStore) AcceptNonceCount(id, cnonce string, nc uint64, ttl time.Time) (bool, error) {
+	st := <-m.state
+	defer func() { m.state <- st }()
+
+	if v, ok := st.get("nc:" + id); ok {
+		if n, _ := strconv.ParseUint(string(v.v), 10, 64); nc <= n {
+			return false, nil
+		}
+	}
+	if _, ok := st.get("cnonce:" + id + ":" + cnonce); ok {
+		return false, nil
+	}
+	st.data["cnonce:"+id+":"+cnonce] = memoryEntry{v: []byte("1"), exp: ttl}
+	st.data["nc:"+id] = memoryEntry{v: []byte(strconv.FormatUint(nc, 10)), exp: ttl}
+	return true, nil
+}
+
+func (m *MemoryStore) PublishRevocation(btid string) error {
+	st := <-m.state
+	handlers := st.handlers
+	m.state <- st
+
+	for _, f := range handlers {
+		f(btid)
+	}
+	return nil
+}
+
+func (m *MemoryStore) SubscribeRevocation(f func(btid string)) {
+	st := <-m.state
+	st.handlers = append(st.handlers, f)
+	m.state <- st
+}
@@ -0,0 +1,130 @@
+package bag
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// SessionKeys is AES key-encryption keys of sessions in the store with key ID.
+// If set, session is sealed under the key of SessionKeyID with the B-TID as associated data,
+// and keys of the other IDs are used to open sessions sealed before key rotation.
+var (
+	SessionKeys  map[string][]byte
+	SessionKeyID string
+)
+
+const sealedPrefix = "sealed:"
+
+func sessionAEAD(id string) (cipher.AEAD, error) {
+	k, ok := SessionKeys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown session key ID %s", id)
+	}
+	b, e := aes.NewCipher(k)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(b)
+}
+
+// sealedKeyID returns key ID and sealed data of the session data in the store
+func sealedKeyID(data []byte) (id string, ct []byte, ok bool) {
+	if !bytes.HasPrefix(data, []byte(sealedPrefix)) {
+		return
+	}
+	i, c, ok := bytes.Cut(data[len(sealedPrefix):], []byte(":"))
+	return string(i), c, ok
+}
+
+// marshalSession returns session data in the store, sealed if SessionKeys is set
+func marshalSession(btid string, s Session) ([]byte, error) {
+	pt, e := s.MarshalText()
+	if e != nil || SessionKeys == nil {
+		return pt, e
+	}
+	aead, e := sessionAEAD(SessionKeyID)
+	if e != nil {
+		return nil, e
+	}
+	iv := make([]byte, aead.NonceSize())
+	rand.Read(iv)
+	ct := aead.Seal(iv, iv, pt, []byte(btid))
+	return []byte(sealedPrefix + SessionKeyID + ":" + base64.StdEncoding.EncodeToString(ct)), nil
+}
+
+// unmarshalSession returns session of the data in the store.
+// Plain data is accepted only if SessionKeys is not set or plain is true.
+func unmarshalSession(btid string, data []byte, plain bool) (s Session, e error) {
+	if id, ct, ok := sealedKeyID(data); ok {
+		var aead cipher.AEAD
+		if aead, e = sessionAEAD(id); e != nil {
+			return
+		}
+		if ct, e = base64.StdEncoding.DecodeString(string(ct)); e != nil || len(ct) < aead.NonceSize() {
+			e = errors.New("invalid sealed session")
+			return
+		}
+		ns := aead.NonceSize()
+		if data, e = aead.Open(nil, ct[:ns], ct[ns:], []byte(btid)); e != nil {
+			e = errors.New("invalid sealed session")
+			return
+		}
+	} else if SessionKeys != nil && !plain {
+		e = errors.New("session is not sealed")
+		return
+	}
+	e = s.UnmarshalText(data)
+	return
+}
+
+// ReEncryptSessions seals all sessions in the store under the key of SessionKeyID.
+// Sessions sealed with old key or not sealed are written again with the same expiry,
+// only if they are not updated after read.
+func ReEncryptSessions(st SessionStore) (n int, e error) {
+	impis, e := st.IMPIs()
+	if e != nil {
+		return
+	}
+	for _, impi := range impis {
+		var ids []string
+		if ids, e = st.ListSessions(impi); e != nil {
+			return
+		}
+		for _, id := range ids {
+			data, ttl, err := st.Get(id)
+			if err != nil {
+				return n, err
+			}
+			if data == nil || ttl.IsZero() {
+				continue
+			}
+			if kid, _, ok := sealedKeyID(data); ok && kid == SessionKeyID {
+				continue
+			}
+			s, err := unmarshalSession(id, data, true)
+			if err != nil {
+				Log("[ERR]", "failed to open session", id, "of", impi, ":", err)
+				continue
+			}
+			var v []byte
+			if v, e = marshalSession(id, s); e != nil {
+				return
+			}
+			// session updated while re-encryption is kept
+			var ok bool
+			if ok, e = st.CompareAndSwap(id, data, v); e != nil {
+				return
+			} else if !ok {
+				Log("[INFO]", "session", id, "of", impi, "is updated during re-encryption, skipped")
+				continue
+			}
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,38 @@
+package bag
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+// P0 value of TMPI derivation
+const LabelTMPI = "3gpp-gba-tmpi"
+
+// TMPIProductToken is product token of UE and BSF supporting TMPI
+const TMPIProductToken = "3gpp-gba-tmpi"
+
+// TMPI returns temporary IMPI derived from Ks as
+// base64(Trunc(KDF(Ks, "3gpp-gba-tmpi")))@tmpi.BSF_server_domain_name.
+// UE and BSF derive the same TMPI after bootstrap, so it is not sent on the network.
+func TMPI(ks []byte, domain string) string {
+	k, _ := KDF(ks, FCGBA, KDFParam(LabelTMPI))
+	return base64.StdEncoding.EncodeToString(k[:16]) + "@tmpi." + domain
+}
+
+// IsTMPI returns true if the username is TMPI
+func IsTMPI(name string) bool {
+	i := strings.LastIndex(name, "@")
+	return i > 0 && strings.HasPrefix(name[i+1:], "tmpi.")
+}
+
+// resolveTMPI returns IMPI of the TMPI, empty if the TMPI is unknown
+func resolveTMPI(tmpi string) (string, error) {
+	data, _, e := Store.Get("tmpi:" + tmpi)
+	return string(data), e
+}
+
+// setTMPI records IMPI of the TMPI until the bootstrapping session expires
+func setTMPI(tmpi, impi string, ttl time.Time) error {
+	return Store.Set("tmpi:"+tmpi, []byte(impi), ttl)
+}
@@ -0,0 +1,430 @@
+package bag
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fkgi/diameter"
+	"github.com/fkgi/diameter/connector"
+)
+
+// NAFKey is key material of the B-TID for the NAF
+type NAFKey struct {
+	Ks       []byte    // Ks_NAF of GBA_ME or Ks_ext_NAF of GBA_U
+	KsInt    []byte    // Ks_int_NAF of GBA_U, nil if not provided
+	Type     GBAType   // GBA-Type
+	IMPI     string    // IMPI of the subscriber
+	Expire   time.Time // Key-ExpiryTime
+	BootTime time.Time // BootstrapInfoCreationTime
+	GUSS     *GUSS     // GBA-UserSecSettings, nil if not provided
+}
+
+// ZnRequest is used by NAF to retrieve key material from BSF.
+// Default value refers the BSF in the same process.
+// gbaU is GBA_U awareness of the NAF to request Ks_int_NAF.
+var ZnRequest func(btid string, nafid NAFID, gbaU bool) (NAFKey, error) = LocalBootstrappingInfo
+
+var (
+	// ErrUnknownBTID is returned when the B-TID is not found or not bootstrapped.
+	ErrUnknownBTID = errors.New("unknown B-TID")
+	// ErrInvalidNAFID is returned when NAF_ID format is invalid.
+	ErrInvalidNAFID = errors.New("invalid NAF_ID")
+)
+
+// LocalBootstrappingInfo returns key material of the B-TID from the BSF in this process.
+func LocalBootstrappingInfo(btid string, nafid NAFID, gbaU bool) (k NAFKey, e error) {
+	if nafid.FQDN == "" {
+		e = ErrInvalidNAFID
+		return
+	}
+	s, ttl, e := Store.GetSession(btid)
+	if e != nil {
+		return
+	}
+	if ttl.IsZero() || s.BootTime.IsZero() {
+		e = ErrUnknownBTID
+		return
+	}
+
+	if s.Type == GBADigest {
+		k.Ks, _ = KsDigestNAF(Ks(s.AV.CK, s.AV.IK), s.AV.RAND, s.AV.IMPI, nafid.Bytes())
+	} else {
+		k.Ks = KeyDerivation(s.AV.CK, s.AV.IK, s.AV.RAND, s.AV.IMPI, nafid)
+	}
+	k.Type = s.Type
+	if s.Type == GBAU && gbaU {
+		k.KsInt, _ = KsIntNAF(Ks(s.AV.CK, s.AV.IK), s.AV.RAND, s.AV.IMPI, nafid.Bytes())
+	}
+	k.IMPI = s.AV.IMPI
+	k.Expire = Lifetime.NAFKeyExpire(ttl, s.BootTime)
+	k.BootTime = s.BootTime
+	k.GUSS = s.GUSS
+	return
+}
+
+/*
+Boot-Info-Request
+ <BIR> ::= < Diameter Header: 310, REQ, PXY, 16777220 >
+           < Session-Id >
+           { Vendor-Specific-Application-Id }
+           { Origin-Host }                   ; Address of NAF
+           { Origin-Realm }                  ; Realm of NAF
+           { Destination-Realm }             ; Realm of BSF
+           [ Destination-Host ]              ; Address of the BSF
+          *[ GAA-Service-Identifier ]        ; not supported
+           { Transaction-Identifier }        ; B-TID
+           { NAF-Id }                        ; NAF_ID
+           [ GBA_U-Awareness-Indicator ]
+          *[ AVP ]
+          *[ Proxy-Info ]
+          *[ Route-Record ]
+
+Boot-Info-Answer
+ <BIA> ::= < Diameter Header: 310, PXY, 16777220 >
+           < Session-Id >
+           { Vendor-Specific-Application-Id }
+           [ Result-Code ]
+           [ Experimental-Result ]
+           { Origin-Host }                   ; Address of BSF
+           { Origin-Realm }                  ; Realm of BSF
+           [ User-Name ]                     ; IMPI
+           [ ME-Key-Material ]               ; Ks_NAF or Ks_ext_NAF
+           [ UICC-Key-Material ]             ; Ks_int_NAF
+           [ Key-ExpiryTime ]
+           [ BootstrapInfoCreationTime ]
+           [ GBA-UserSecSettings ]
+           [ GBA-Type ]
+          *[ AVP ]
+          *[ Proxy-Info ]
+          *[ Route-Record ]
+*/
+
+var birHandler = diameter.Handle(310, 16777220, 10415, nil, connector.DefaultRouter)
+
+// BootstrappingInfoRequest retrieves key material of the B-TID from remote BSF with Zn Diameter.
+func BootstrappingInfoRequest(btid string, nafid NAFID, gbaU bool) (k NAFKey, e error) {
+	reqavp := []diameter.AVP{
+		diameter.SetSessionID(diameter.NextSession(diameter.Host.String())),
+		diameter.SetVendorSpecAppID(10415, 16777220),
+		diameter.SetOriginHost(diameter.Host),
+		diameter.SetOriginRealm(diameter.Realm),
+		diameter.SetDestinationRealm(diameter.Realm),
+		// Destination-Host
+		// GAA-Service-Identifier
+		setTransactionIdentifier(btid),
+		setNAFID(nafid),
+		SetGBAUAwarenessIndicator(gbaU),
+		// Proxy-Info
+		// Route-Record
+	}
+	_, avps := birHandler(false, reqavp)
+
+	var result uint32
+	for _, a := range avps {
+		switch a.Code {
+		case 263:
+			// Session-Id
+		case 260:
+			// Vendor-Specific-Application-Id
+		case 268, 297:
+			// Result-Code
+			// Experimental-Result
+			result, e = diameter.GetResultCode(a)
+		case 264:
+			// Origin-Host
+		case 296:
+			// Origin-Realm
+		case 1:
+			// User-Name
+			k.IMPI, e = diameter.GetUserName(a)
+		case 405:
+			// ME-Key-Material
+			k.Ks, e = getMEKeyMaterial(a)
+		case 406:
+			// UICC-Key-Material
+			k.KsInt, e = getUICCKeyMaterial(a)
+		case 404:
+			// Key-ExpiryTime
+			k.Expire, e = getTimeAVP(a)
+		case 408:
+			// BootstrapInfoCreationTime
+			k.BootTime, e = getTimeAVP(a)
+		case 400:
+			// GBA-UserSecSettings
+			k.GUSS, e = GetGBAUserSecSettings(a)
+		case 410:
+			// GBA-Type
+			k.Type, e = getGBAType(a)
+		case 284:
+			// Proxy-Info
+		case 282:
+			// Route-Record
+		}
+		if e != nil {
+			return
+		}
+	}
+
+	if len(k.KsInt) != 0 {
+		k.Type = GBAU
+	}
+	if result == TransactionIdentifierInvalid {
+		e = ErrUnknownBTID
+	} else if result != diameter.Success {
+		e = fmt.Errorf("failed result %d from BSF", result)
+	} else if len(k.Ks) == 0 {
+		e = fmt.Errorf("no ME-Key-Material from BSF")
+	} else if k.Expire.IsZero() {
+		e = fmt.Errorf("no Key-ExpiryTime from BSF")
+	}
+	return
+}
+
+// BootstrappingInfoHandler handles Boot-Info-Request from NAF with the BSF in this process.
+// Origin-Host of the NAF must be same as FQDN of the NAF_ID in the request.
+func BootstrappingInfoHandler(retry bool, avps []diameter.AVP) (bool, []diameter.AVP) {
+	var btid string
+	var origin diameter.Identity
+	var nafid NAFID
+	var gbaU bool
+	var session string
+	var e error
+	for _, a := range avps {
+		switch a.Code {
+		case 263: // Session-Id
+			if len(session) != 0 {
+				e = diameter.InvalidAVP{Code: diameter.AvpOccursTooManyTimes, AVP: a}
+			} else {
+				session, e = diameter.GetSessionID(a)
+			}
+		case 260: // Vendor-Specific-Application-Id
+		case 264: // Origin-Host
+			origin, e = diameter.GetOriginHost(a)
+		case 296: // Origin-Realm
+		case 293: // Destination-Host
+		case 283: // Destination-Realm
+		case 403: // GAA-Service-Identifier
+		case 401: // Transaction-Identifier
+			if len(btid) != 0 {
+				e = diameter.InvalidAVP{Code: diameter.AvpOccursTooManyTimes, AVP: a}
+			} else {
+				btid, e = getTransactionIdentifier(a)
+			}
+		case 402: // NAF-Id
+			if len(nafid.FQDN) != 0 {
+				e = diameter.InvalidAVP{Code: diameter.AvpOccursTooManyTimes, AVP: a}
+			} else {
+				nafid, e = getNAFID(a)
+			}
+		case 407: // GBA_U-Awareness-Indicator
+			gbaU, e = GetGBAUAwarenessIndicator(a)
+		case 284: // Proxy-Info
+		case 282: // Route-Record
+		default:
+			if a.Mandatory {
+				e = diameter.InvalidAVP{Code: diameter.AvpUnsupported, AVP: a}
+			}
+		}
+		if e != nil {
+			break
+		}
+	}
+
+	result := diameter.Success
+	var k NAFKey
+
+	if iavp, ok := e.(diameter.InvalidAVP); ok {
+		result = iavp.Code
+	} else if len(session) == 0 {
+		result = diameter.MissingAvp
+	} else if len(btid) == 0 {
+		result = diameter.MissingAvp
+	} else if len(nafid.FQDN) == 0 {
+		result = diameter.MissingAvp
+	} else if !strings.EqualFold(string(origin), nafid.FQDN) {
+		Log("[INFO]", "Zn request from", origin, "rejected:", "NAF_ID", nafid.FQDN, "is not the peer")
+		result = diameter.AuthorizationRejected
+	} else if k, e = LocalBootstrappingInfo(btid, nafid, gbaU); e == ErrUnknownBTID {
+		result = TransactionIdentifierInvalid
+	} else if e == ErrInvalidNAFID {
+		result = diameter.InvalidAvpValue
+	} else if e != nil {
+		result = diameter.UnableToComply
+	}
+
+	res := []diameter.AVP{}
+	if session != "" {
+		res = append(res, diameter.SetSessionID(session))
+	}
+	res = append(res,
+		diameter.SetVendorSpecAppID(10415, 16777220),
+		diameter.SetResultCode(result),
+		diameter.SetOriginHost(diameter.Host),
+		diameter.SetOriginRealm(diameter.Realm))
+
+	if result == diameter.Success {
+		res = append(res,
+			diameter.SetUserName(k.IMPI),
+			setMEKeyMaterial(k.Ks),
+			setTimeAVP(404, k.Expire),
+			setTimeAVP(408, k.BootTime))
+		if len(k.KsInt) != 0 {
+			res = append(res, setUICCKeyMaterial(k.KsInt))
+		}
+		if k.GUSS != nil {
+			res = append(res, SetGBAUserSecSettings(k.GUSS))
+		}
+		res = append(res, setGBAType(k.Type))
+	}
+	return false, res
+}
+
+// Transaction-Identifier
+func setTransactionIdentifier(btid string) (a diameter.AVP) {
+	a = diameter.AVP{Code: 401, VendorID: 10415, Mandatory: true}
+	a.Encode([]byte(btid))
+	return
+}
+
+func getTransactionIdentifier(a diameter.AVP) (btid string, e error) {
+	var b []byte
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+	} else if e = a.Decode(&b); e == nil {
+		btid = string(b)
+	}
+	return
+}
+
+// NAF-Id
+func setNAFID(nafid NAFID) (a diameter.AVP) {
+	a = diameter.AVP{Code: 402, VendorID: 10415, Mandatory: true}
+	a.Encode(nafid.Bytes())
+	return
+}
+
+func getNAFID(a diameter.AVP) (nafid NAFID, e error) {
+	var b []byte
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+	} else if e = a.Decode(&b); e != nil {
+	} else if nafid, e = ParseNAFID(b); e != nil {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpValue, AVP: a}
+	}
+	return
+}
+
+// ME-Key-Material
+func setMEKeyMaterial(ks []byte) (a diameter.AVP) {
+	a = diameter.AVP{Code: 405, VendorID: 10415, Mandatory: true}
+	a.Encode(ks)
+	return
+}
+
+func getMEKeyMaterial(a diameter.AVP) (ks []byte, e error) {
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+	} else {
+		e = a.Decode(&ks)
+	}
+	return
+}
+
+// UICC-Key-Material
+func setUICCKeyMaterial(ks []byte) (a diameter.AVP) {
+	a = diameter.AVP{Code: 406, VendorID: 10415, Mandatory: true}
+	a.Encode(ks)
+	return
+}
+
+func getUICCKeyMaterial(a diameter.AVP) (ks []byte, e error) {
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+	} else {
+		e = a.Decode(&ks)
+	}
+	return
+}
+
+// SetGBAUAwarenessIndicator make GBA_U-Awareness-Indicator AVP
+func SetGBAUAwarenessIndicator(gbaU bool) (a diameter.AVP) {
+	a = diameter.AVP{Code: 407, VendorID: 10415, Mandatory: true}
+	if gbaU {
+		a.Encode(diameter.Enumerated(1))
+	} else {
+		a.Encode(diameter.Enumerated(0))
+	}
+	return
+}
+
+// GetGBAUAwarenessIndicator read GBA_U-Awareness-Indicator AVP
+func GetGBAUAwarenessIndicator(a diameter.AVP) (gbaU bool, e error) {
+	var v diameter.Enumerated
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+	} else if e = a.Decode(&v); e != nil {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpLength, AVP: a}
+	} else if v != 0 && v != 1 {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpValue, AVP: a}
+	} else {
+		gbaU = v == 1
+	}
+	return
+}
+
+// GBA-Type, 3G GBA (0) for GBA_ME and GBA_U, 2G GBA (1) or GBA Digest (2)
+func setGBAType(t GBAType) (a diameter.AVP) {
+	a = diameter.AVP{Code: 410, VendorID: 10415, Mandatory: true}
+	switch t {
+	case GBA2G:
+		a.Encode(diameter.Enumerated(1))
+	case GBADigest:
+		a.Encode(diameter.Enumerated(2))
+	default:
+		a.Encode(diameter.Enumerated(0))
+	}
+	return
+}
+
+func getGBAType(a diameter.AVP) (t GBAType, e error) {
+	var v diameter.Enumerated
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+	} else if e = a.Decode(&v); e != nil {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpLength, AVP: a}
+	} else if v == 0 {
+		t = GBAME
+	} else if v == 1 {
+		t = GBA2G
+	} else if v == 2 {
+		t = GBADigest
+	} else {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpValue, AVP: a}
+	}
+	return
+}
+
+// Key-ExpiryTime, BootstrapInfoCreationTime and GUSS-Timestamp
+// are Time format AVP with 32 bit NTP seconds.
+func setTimeAVP(code uint32, t time.Time) (a diameter.AVP) {
+	a = diameter.AVP{Code: code, VendorID: 10415, Mandatory: true}
+	a.Encode(uint32(t.Unix() + 2208988800))
+	return
+}
+
+func getTimeAVP(a diameter.AVP) (t time.Time, e error) {
+	var v uint32
+	if a.VendorID != 10415 || !a.Mandatory {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpBits, AVP: a}
+	} else if e = a.Decode(&v); e != nil {
+		e = diameter.InvalidAVP{Code: diameter.InvalidAvpLength, AVP: a}
+	} else {
+		t = time.Unix(int64(v)-2208988800, 0).UTC()
+	}
+	return
+}
+
+// TransactionIdentifierInvalid Diameter response code
+const TransactionIdentifierInvalid uint32 = 10415*10000 + 5403
@@ -0,0 +1,168 @@
+package bag
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+var (
+	// ZnURL is HTTPS URL of the HTTP/JSON Zn API of remote BSF
+	ZnURL = "https://localhost:8080/zn"
+	// ZnClient is HTTP client for the HTTP/JSON Zn API.
+	// Its transport must present the client certificate of the NAF.
+	ZnClient = &http.Client{Timeout: time.Second * 3}
+)
+
+type znAPIRequest struct {
+	BTID  string `json:"btid"`
+	NAFID string `json:"nafId"`
+	UaSPI string `json:"uaSecurityProtocolId"` // 5 octets hex
+	GBAU  bool   `json:"gbaUAwareness,omitempty"`
+}
+
+type znAPIAnswer struct {
+	Ks       []byte    `json:"ksNaf"`
+	KsInt    []byte    `json:"ksIntNaf,omitempty"`
+	Type     string    `json:"gbaType,omitempty"`
+	Lifetime time.Time `json:"lifetime"`
+	IMPI     string    `json:"impi"`
+	BootTime time.Time `json:"bootTime"`
+	GUSS     string    `json:"guss,omitempty"` // GUSS XML document
+}
+
+// HTTPBootstrappingInfoRequest retrieves key material of the B-TID from remote BSF with HTTP/JSON Zn API.
+func HTTPBootstrappingInfoRequest(btid string, nafid NAFID, gbaU bool) (k NAFKey, e error) {
+	data, _ := json.Marshal(znAPIRequest{
+		BTID:  btid,
+		NAFID: nafid.FQDN,
+		UaSPI: hex.EncodeToString(nafid.UaSPI[:]),
+		GBAU:  gbaU})
+
+	res, e := ZnClient.Post(ZnURL, "application/json", bytes.NewReader(data))
+	if e != nil {
+		return
+	}
+	defer res.Body.Close()
+	data, e = io.ReadAll(res.Body)
+	if e != nil {
+		return
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		e = ErrUnknownBTID
+		return
+	default:
+		e = fmt.Errorf("failed result %s from BSF", res.Status)
+		return
+	}
+
+	a := znAPIAnswer{}
+	if e = json.Unmarshal(data, &a); e != nil {
+		return
+	}
+	if len(a.Ks) == 0 {
+		e = fmt.Errorf("no Ks_NAF from BSF")
+	} else if a.Lifetime.IsZero() {
+		e = fmt.Errorf("no lifetime from BSF")
+	} else {
+		k = NAFKey{
+			Ks:       a.Ks,
+			KsInt:    a.KsInt,
+			IMPI:     a.IMPI,
+			Expire:   a.Lifetime,
+			BootTime: a.BootTime}
+		if a.Type != "" {
+			k.Type, e = ParseGBAType(a.Type)
+		}
+		if e == nil && a.GUSS != "" {
+			k.GUSS, e = ParseGUSS([]byte(a.GUSS))
+		}
+	}
+	return
+}
+
+// ZnAPIHandler handles HTTP/JSON Zn API request from NAF with the BSF in this process.
+// It must be served with TLS that verifies client certificate,
+// and the certificate of the NAF must be valid for the NAF_ID in the request.
+func ZnAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", productName+" BSF")
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		Log("[INFO]", "Zn API request from", r.RemoteAddr, "rejected:", "no verified client certificate")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := znAPIRequest{}
+	data, e := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	if e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if e = json.Unmarshal(data, &req); e != nil || req.BTID == "" || req.NAFID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	nafid := NAFID{FQDN: req.NAFID}
+	if spi, e := hex.DecodeString(req.UaSPI); e != nil || len(spi) != 5 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	} else {
+		copy(nafid.UaSPI[:], spi)
+	}
+	host := req.NAFID
+	if h, _, e := net.SplitHostPort(host); e == nil {
+		host = h
+	}
+	if e = r.TLS.PeerCertificates[0].VerifyHostname(host); e != nil {
+		Log("[INFO]", "Zn API request for", req.NAFID, "rejected:", e)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	k, e := LocalBootstrappingInfo(req.BTID, nafid, req.GBAU)
+	if e == ErrUnknownBTID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if e != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	a := znAPIAnswer{
+		Ks:       k.Ks,
+		KsInt:    k.KsInt,
+		Type:     k.Type.String(),
+		Lifetime: k.Expire,
+		IMPI:     k.IMPI,
+		BootTime: k.BootTime}
+	if k.GUSS != nil {
+		if data, e = xml.Marshal(k.GUSS); e != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		a.GUSS = string(data)
+	}
+	data, e = json.Marshal(a)
+	if e != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}